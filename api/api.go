@@ -1,16 +1,22 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dvlahovski/go-dnscached/cache"
+	"github.com/dvlahovski/go-dnscached/certs"
 	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/metrics"
 	"github.com/dvlahovski/go-dnscached/server"
+	"github.com/dvlahovski/go-dnscached/stats"
 	"github.com/miekg/dns"
 )
 
@@ -43,10 +49,6 @@ func requiredParam(w http.ResponseWriter, req *http.Request, key string) (string
 	return value, true
 }
 
-func enableCors(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-}
-
 // API insance
 type API struct {
 	server *server.Server
@@ -57,10 +59,10 @@ type API struct {
 func (api *API) cacheList(w http.ResponseWriter, req *http.Request) {
 	jsonString, err := json.Marshal(api.cache)
 	if err != nil {
-		log.Printf("%s", err)
+		slog.Error("json marshal failed", "err", err)
 		http.NotFound(w, req)
 	}
-	fmt.Fprintf(w, string(jsonString))
+	w.Write(jsonString)
 }
 
 // get a specific entry from the cache, by key = FQDN.TYPE
@@ -84,15 +86,171 @@ func (api *API) cacheGet(w http.ResponseWriter, req *http.Request) {
 
 	jsonString, err := json.Marshal(entry)
 	if err != nil {
-		log.Printf("%s", err)
+		slog.Error("json marshal failed", "err", err)
+		http.NotFound(w, req)
+	}
+	w.Write(jsonString)
+}
+
+// get the query statistics over the configured window in JSON
+func (api *API) statsGet(w http.ResponseWriter, req *http.Request) {
+	jsonString, err := json.Marshal(api.server.Stats().Snapshot())
+	if err != nil {
+		slog.Error("json marshal failed", "err", err)
 		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonString)
+}
+
+// stream the handled queries as server-sent events
+// with the optional param filter only the names containing it are sent
+func (api *API) queryStream(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Streaming unsupported!"))
+		return
+	}
+
+	// the stream outlives the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.Warn("could not clear the write deadline of the query stream", "err", err)
+	}
+
+	filter := strings.ToLower(req.URL.Query().Get("filter"))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	feed := api.server.Feed()
+	queries := feed.Subscribe()
+	defer feed.Unsubscribe(queries)
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case entry := <-queries:
+			if filter != "" && !strings.Contains(strings.ToLower(entry.Name), filter) {
+				continue
+			}
+
+			jsonString, err := json.Marshal(entry)
+			if err != nil {
+				slog.Error("json marshal failed", "err", err)
+				continue
+			}
+
+			fmt.Fprintf(w, "data: %s\n\n", jsonString)
+			flusher.Flush()
+		}
+	}
+}
+
+// get the running config (GET) or replace it with the JSON body (PUT)
+// the new config is validated, applied live and stored in the config file
+func (api *API) configHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		cfg := new(config.Config)
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "400 - Bad Request!\nInvalid JSON config: %s", err)
+			return
+		}
+
+		if err := api.server.Update(cfg); err != nil {
+			slog.Error("config update failed", "err", err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "400 - Bad Request!\nConfig update failed: %s", err)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("405 - Method Not Allowed!"))
+		return
+	}
+
+	jsonString, err := json.MarshalIndent(api.server.Config(), "", "    ")
+	if err != nil {
+		slog.Error("json marshal failed", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
-	fmt.Fprintf(w, string(jsonString))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonString)
+}
+
+// UpstreamStatus is an upstream server with its statistics over the stats window
+type UpstreamStatus struct {
+	stats.Upstream
+	Protocol string
+}
+
+// Get the upstream servers with their statistics
+func (api *API) upstreamStatuses() []UpstreamStatus {
+	latencies := make(map[string]stats.Upstream)
+	for _, u := range api.server.Stats().Snapshot().Upstreams {
+		latencies[u.Upstream] = u
+	}
+
+	servers, serversHttps := api.server.Upstreams()
+	upstreams := make([]UpstreamStatus, 0, len(servers)+len(serversHttps))
+	for _, server := range serversHttps {
+		status := UpstreamStatus{Upstream: latencies[server], Protocol: "https"}
+		status.Upstream.Upstream = server
+		upstreams = append(upstreams, status)
+	}
+	for _, server := range servers {
+		status := UpstreamStatus{Upstream: latencies[server], Protocol: "udp"}
+		status.Upstream.Upstream = server
+		upstreams = append(upstreams, status)
+	}
+
+	return upstreams
+}
+
+// get the upstream servers with their latencies in JSON
+func (api *API) upstreams(w http.ResponseWriter, req *http.Request) {
+	jsonString, err := json.Marshal(api.upstreamStatuses())
+	if err != nil {
+		slog.Error("json marshal failed", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonString)
+}
+
+// re-read the config file and apply it to the running server
+func (api *API) configReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("405 - Method Not Allowed!"))
+		return
+	}
+
+	if err := api.server.Reload(); err != nil {
+		slog.Error("config reload failed", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "400 - Bad Request!\nConfig reload failed: %s", err)
+		return
+	}
+
+	fmt.Fprintf(w, "Successfully reloaded %s", api.server.Config().Path())
 }
 
 // delete a record from the cache by key = FQDN.TYPE
 func (api *API) cacheDelete(w http.ResponseWriter, req *http.Request) {
-	enableCors(&w)
 	value, exists := getParams(req, "key")
 
 	if !exists {
@@ -117,7 +275,6 @@ func (api *API) cacheDelete(w http.ResponseWriter, req *http.Request) {
 // ttl in seconds (0 for permanent)
 // value - IP address
 func (api *API) cacheInsert(w http.ResponseWriter, req *http.Request) {
-	enableCors(&w)
 	all := true
 	key, exists := requiredParam(w, req, "key")
 	all = all && exists
@@ -155,23 +312,70 @@ func (api *API) cacheInsert(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// Run the API HTTP server
-func Run(server *server.Server, cache *cache.Cache, cfg *config.ApiConfig) error {
+// New returns the API HTTP server, ready to ListenAndServe
+// or, if its TLSConfig is set, ListenAndServeTLS.
+// A ui handler, if not nil, is served under /ui/ with the API authentication,
+// so its pages need the read scope.
+func New(server *server.Server, cache *cache.Cache, cfg *config.ApiConfig, ui http.Handler) (*http.Server, error) {
 	api := new(API)
 	api.cache = cache
 	api.server = server
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/cache/all", api.cacheList)
-	mux.HandleFunc("/cache/get", api.cacheGet)
-	mux.HandleFunc("/cache/delete", api.cacheDelete)
-	mux.HandleFunc("/cache/insert", api.cacheInsert)
+	mux.HandleFunc("/v1/cache", api.v1CacheList)
+	mux.HandleFunc("/v1/cache/{name}/{type}", api.v1CacheEntry)
+	mux.HandleFunc("/v1/cache/flush", api.v1CacheFlush)
+	mux.HandleFunc("/v1/cache/bulk", api.v1CacheBulk)
+	mux.HandleFunc("/v1/stats", api.v1Stats)
+	mux.HandleFunc("/v1/upstreams", api.v1Upstreams)
+	mux.HandleFunc("/v1/queries/stream", api.v1QueryStream)
+	mux.HandleFunc("/v1/config", api.v1Config)
+	mux.HandleFunc("/v1/config/reload", api.v1ConfigReload)
+	mux.HandleFunc("/v1/", api.v1NotFound)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/openapi.json", api.openApi)
+
+	// deprecated aliases of the /v1 API
+	mux.HandleFunc("/cache/all", deprecated("/v1/cache", api.cacheList))
+	mux.HandleFunc("/cache/get", deprecated("/v1/cache/{name}/{type}", api.cacheGet))
+	mux.HandleFunc("/cache/delete", deprecated("/v1/cache/{name}/{type}", api.cacheDelete))
+	mux.HandleFunc("/cache/insert", deprecated("/v1/cache/{name}/{type}", api.cacheInsert))
+	mux.HandleFunc("/stats", deprecated("/v1/stats", api.statsGet))
+	mux.HandleFunc("/upstreams", deprecated("/v1/upstreams", api.upstreams))
+	mux.HandleFunc("/queries/stream", deprecated("/v1/queries/stream", api.queryStream))
+	mux.HandleFunc("/config", deprecated("/v1/config", api.configHandler))
+	mux.HandleFunc("/config/reload", deprecated("/v1/config/reload", api.configReload))
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		http.NotFound(w, req)
 	})
 
-	s := &http.Server{Addr: cfg.Address, Handler: mux, WriteTimeout: 1 * time.Second}
-	log.Printf("Starting REST API server on %s", s.Addr)
-	return s.ListenAndServe()
+	handler := api.authenticate(mux)
+	if ui != nil {
+		shared := http.NewServeMux()
+		shared.Handle("/", handler)
+		shared.Handle("/ui/", api.authenticate(http.StripPrefix("/ui", ui)))
+		shared.Handle("GET /{$}", http.RedirectHandler("/ui/", http.StatusFound))
+		handler = shared
+	}
+
+	// the query streams never go idle, so end them when shutting down
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &http.Server{
+		Addr:         cfg.Address,
+		Handler:      handler,
+		WriteTimeout: 1 * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return ctx },
+	}
+	s.RegisterOnShutdown(cancel)
+
+	if cfg.TLS.Enabled() {
+		reloader, err := certs.New(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		s.TLSConfig = reloader.TLSConfig()
+	}
+
+	return s, nil
 }
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dvlahovski/go-dnscached/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// paths that need the admin scope for any method
+var adminPaths = map[string]bool{
+	"/v1/config":        true,
+	"/v1/config/reload": true,
+	"/config":           true,
+	"/config/reload":    true,
+	"/cache/insert":     true,
+	"/cache/delete":     true,
+}
+
+// paths open to anyone
+var publicPaths = map[string]bool{
+	"/openapi.json": true,
+}
+
+// Get the scope needed for a request: reading needs the read scope,
+// changing anything and reading the config (with its secrets) needs admin
+func requiredScope(req *http.Request) string {
+	if adminPaths[req.URL.Path] {
+		return config.ScopeAdmin
+	}
+
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return config.ScopeRead
+	}
+
+	return config.ScopeAdmin
+}
+
+// Get the scope of the credentials of a request, if they are valid
+func scopeOf(cfg *config.ApiConfig, req *http.Request) (string, bool) {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		for _, t := range cfg.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+				return t.Scope, true
+			}
+		}
+		return "", false
+	}
+
+	if username, password, ok := req.BasicAuth(); ok {
+		for _, u := range cfg.Users {
+			if u.Username == username {
+				if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil {
+					return u.Scope, true
+				}
+				return "", false
+			}
+		}
+	}
+
+	return "", false
+}
+
+// Check if a scope allows what the required scope allows
+func allows(scope string, required string) bool {
+	return scope == config.ScopeAdmin || scope == required
+}
+
+// Set the CORS headers for the allowed origins and answer the preflight requests
+func cors(cfg *config.ApiConfig, w http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+
+	allowed := ""
+	for _, o := range cfg.CorsOrigins {
+		if o == "*" || o == origin {
+			allowed = o
+			break
+		}
+	}
+
+	if allowed == "" {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	w.Header().Add("Vary", "Origin")
+	w.Header().Set("Access-Control-Expose-Headers", "Link, X-Total-Count, X-Next-Cursor")
+
+	if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+
+	return false
+}
+
+// Respond to a request without valid credentials, in JSON for the /v1 API
+func denied(w http.ResponseWriter, req *http.Request, status int, message string) {
+	if strings.HasPrefix(req.URL.Path, "/v1/") {
+		writeError(w, status, "%s", message)
+		return
+	}
+
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%d - %s!", status, http.StatusText(status))
+}
+
+// authenticate is the middleware enforcing the CORS origins and, when tokens
+// or users are configured, the authentication of every API request
+func (api *API) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cfg := &api.server.Config().Api
+
+		if cors(cfg, w, req) {
+			return
+		}
+
+		if authorized(cfg, w, req) {
+			next.ServeHTTP(w, req)
+		}
+	})
+}
+
+// Authenticate is the API authentication, without the CORS origins, for
+// the handlers served apart from the API, e.g. the web GUI on its own port.
+// apiConfig returns the current API config.
+func Authenticate(apiConfig func() *config.ApiConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if authorized(apiConfig(), w, req) {
+			next.ServeHTTP(w, req)
+		}
+	})
+}
+
+// Check that the credentials of a request allow it, when tokens or users
+// are configured, and respond if they don't
+func authorized(cfg *config.ApiConfig, w http.ResponseWriter, req *http.Request) bool {
+	if publicPaths[req.URL.Path] || (len(cfg.Tokens) == 0 && len(cfg.Users) == 0) {
+		return true
+	}
+
+	scope, ok := scopeOf(cfg, req)
+	if !ok {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="go-dnscached"`)
+		if len(cfg.Users) > 0 {
+			w.Header().Add("WWW-Authenticate", `Basic realm="go-dnscached"`)
+		}
+		denied(w, req, http.StatusUnauthorized, "valid credentials are required")
+		return false
+	}
+
+	if !allows(scope, requiredScope(req)) {
+		denied(w, req, http.StatusForbidden, "the admin scope is required")
+		return false
+	}
+
+	return true
+}
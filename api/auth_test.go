@@ -0,0 +1,161 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dvlahovski/go-dnscached/cache"
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/server"
+	"github.com/dvlahovski/go-dnscached/test"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Get the handler of an API with the given API config
+func getHandler(t *testing.T, apiCfg config.ApiConfig) http.Handler {
+	cfg := test.GetStubConfig()
+	cfg.Api = apiCfg
+	cfg.SetDefaults()
+
+	c := cache.NewCache(*cfg)
+	s, err := server.NewServer(c, cfg, new(test.StubDnsClient), &http.Client{})
+	if err != nil {
+		t.Fatalf("server creation error: %s", err)
+	}
+
+	apiServer, err := New(s, c, &cfg.Api, nil)
+	if err != nil {
+		t.Fatalf("API creation error: %s", err)
+	}
+
+	return apiServer.Handler
+}
+
+func TestAuthentication(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := getHandler(t, config.ApiConfig{
+		Tokens: []config.TokenConfig{
+			{Token: "reader", Scope: config.ScopeRead},
+			{Token: "admin", Scope: config.ScopeAdmin},
+		},
+		Users: []config.UserConfig{
+			{Username: "ops", PasswordHash: string(hash), Scope: config.ScopeAdmin},
+		},
+	})
+
+	cases := []struct {
+		method string
+		path   string
+		auth   func(*http.Request)
+		status int
+	}{
+		{http.MethodGet, "/stats", func(*http.Request) {}, http.StatusUnauthorized},
+		{http.MethodGet, "/stats", bearer("wrong"), http.StatusUnauthorized},
+		{http.MethodGet, "/stats", bearer("reader"), http.StatusOK},
+		{http.MethodGet, "/stats?access_token=reader", func(*http.Request) {}, http.StatusUnauthorized},
+		{http.MethodGet, "/config", bearer("reader"), http.StatusForbidden},
+		{http.MethodGet, "/cache/delete?key=a.bg.A.", bearer("reader"), http.StatusForbidden},
+		{http.MethodGet, "/config", bearer("admin"), http.StatusOK},
+		{http.MethodGet, "/config", basic("ops", "secret"), http.StatusOK},
+		{http.MethodGet, "/config", basic("ops", "wrong"), http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		c.auth(req)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != c.status {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.status, w.Code)
+		}
+	}
+}
+
+func bearer(token string) func(*http.Request) {
+	return func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func basic(username, password string) func(*http.Request) {
+	return func(req *http.Request) {
+		req.SetBasicAuth(username, password)
+	}
+}
+
+func TestCors(t *testing.T) {
+	handler := getHandler(t, config.ApiConfig{CorsOrigins: []string{"http://localhost:8080"}})
+
+	req := httptest.NewRequest(http.MethodOptions, "/cache/all", nil)
+	req.Header.Set("Origin", "http://localhost:8080")
+	req.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "http://localhost:8080" {
+		t.Fatalf("the preflight of an allowed origin should pass, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/stats", nil)
+	req.Header.Set("Origin", "http://evil.example")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("other origins should not be allowed")
+	}
+}
+
+func TestSharePort(t *testing.T) {
+	cfg := test.GetStubConfig()
+	cfg.Api.Tokens = []config.TokenConfig{{Token: "reader", Scope: config.ScopeRead}}
+	cfg.SetDefaults()
+
+	c := cache.NewCache(*cfg)
+	s, err := server.NewServer(c, cfg, new(test.StubDnsClient), &http.Client{})
+	if err != nil {
+		t.Fatalf("server creation error: %s", err)
+	}
+
+	ui := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ui " + req.URL.Path))
+	})
+	apiServer, err := New(s, c, &cfg.Api, ui)
+	if err != nil {
+		t.Fatalf("API creation error: %s", err)
+	}
+
+	cases := []struct {
+		path   string
+		token  string
+		status int
+		body   string
+	}{
+		{"/ui/", "reader", http.StatusOK, "ui /"},
+		{"/ui/stats", "reader", http.StatusOK, "ui /stats"},
+		{"/ui/", "", http.StatusUnauthorized, ""},
+		{"/ui/stats", "wrong", http.StatusUnauthorized, ""},
+		{"/", "", http.StatusFound, ""},
+		{"/v1/stats", "", http.StatusUnauthorized, ""},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		w := httptest.NewRecorder()
+		apiServer.Handler.ServeHTTP(w, req)
+		if w.Code != c.status || !strings.HasPrefix(w.Body.String(), c.body) {
+			t.Errorf("%s: expected %d %q, got %d %q", c.path, c.status, c.body, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// the OpenAPI 3 description of every route, kept in sync with New by TestOpenApi
+//
+//go:embed openapi.json
+var openApiSpec []byte
+
+// GET /openapi.json: the OpenAPI document of the API
+func (api *API) openApi(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet, http.MethodHead) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openApiSpec)
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dvlahovski/go-dnscached/config"
+)
+
+// the routes registered in New
+var routes = []string{
+	"/v1/cache", "/v1/cache/{name}/{type}", "/v1/cache/flush", "/v1/cache/bulk", "/v1/stats", "/v1/upstreams", "/v1/queries/stream",
+	"/v1/config", "/v1/config/reload", "/metrics", "/openapi.json",
+	"/cache/all", "/cache/get", "/cache/delete", "/cache/insert", "/stats", "/upstreams",
+	"/queries/stream", "/config", "/config/reload",
+}
+
+func TestOpenApi(t *testing.T) {
+	handler := getHandler(t, config.ApiConfig{Tokens: []config.TokenConfig{{Token: "admin", Scope: config.ScopeAdmin}}})
+
+	w := serve(handler, http.MethodGet, "/openapi.json", "")
+	var spec struct {
+		OpenApi string
+		Paths   map[string]map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("the spec should be served without credentials, got %d: %s", w.Code, err)
+	}
+
+	if !strings.HasPrefix(spec.OpenApi, "3.") {
+		t.Fatalf("expected an OpenAPI 3 document, got %q", spec.OpenApi)
+	}
+
+	for _, route := range routes {
+		if _, ok := spec.Paths[route]; !ok {
+			t.Errorf("route %s is not in the spec", route)
+		}
+	}
+
+	if len(spec.Paths) != len(routes) {
+		t.Errorf("the spec has %d paths, %d routes are registered", len(spec.Paths), len(routes))
+	}
+
+	// every documented method is served
+	handler = getHandler(t, config.ApiConfig{})
+	for path, operations := range spec.Paths {
+		if strings.Contains(path, "stream") {
+			continue
+		}
+
+		for method := range operations {
+			if method == "parameters" {
+				continue
+			}
+
+			target := strings.NewReplacer("{name}", "example.bg", "{type}", "A").Replace(path)
+			w := serve(handler, strings.ToUpper(method), target, "")
+			if w.Code == http.StatusMethodNotAllowed {
+				t.Errorf("%s %s is documented but not allowed", method, path)
+			}
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dvlahovski/go-dnscached/cache"
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/server"
+	"github.com/miekg/dns"
+)
+
+// Error is the JSON body of the error responses of the /v1 API
+type Error struct {
+	Status  int
+	Message string
+}
+
+// CacheRecord is the JSON body of a PUT to /v1/cache/{name}/{type}.
+// Value is the IP address and Ttl is in seconds, 0 for a permanent record.
+type CacheRecord struct {
+	Value string
+	Ttl   int
+}
+
+// FlushRequest is the JSON body of POST /v1/cache/flush; empty fields match all the entries
+type FlushRequest struct {
+	// a domain name: flush the name and all its subdomains
+	Suffix string
+	// A or AAAA
+	Type string
+}
+
+// FlushResult is the response of POST /v1/cache/flush
+type FlushResult struct {
+	Deleted int
+	Entries []cache.StringEntry
+	// the matching hardcoded records of the config, which are never flushed
+	Kept int
+}
+
+// BulkRecord is a record in the JSON body of POST /v1/cache/bulk
+type BulkRecord struct {
+	Name  string
+	Type  string
+	Value string
+	Ttl   int
+}
+
+// BulkRecordResult is the outcome of inserting a single record, with
+// the status a PUT of the record would have had
+type BulkRecordResult struct {
+	Name    string
+	Type    string
+	Status  int
+	Message string `json:",omitempty"`
+}
+
+// BulkResult is the response of POST /v1/cache/bulk
+type BulkResult struct {
+	Created  int
+	Replaced int
+	Failed   int
+	Results  []BulkRecordResult
+}
+
+// write v as the JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	jsonString, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("json marshal failed", "err", err)
+		status = http.StatusInternalServerError
+		jsonString, _ = json.Marshal(Error{Status: status, Message: http.StatusText(status)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonString)
+}
+
+// write a JSON error response
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, Error{Status: status, Message: fmt.Sprintf(format, args...)})
+}
+
+// check the request method; respond with 405 if it isn't one of methods
+func allowMethods(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+	return false
+}
+
+// Get the record type from the URL, only A and AAAA are cached
+func parseRecordType(recordType string) (string, uint16, bool) {
+	switch strings.ToUpper(recordType) {
+	case "A":
+		return "A", dns.TypeA, true
+	case "AAAA":
+		return "AAAA", dns.TypeAAAA, true
+	}
+
+	return "", 0, false
+}
+
+// Get the listing options from the query params of a cache listing
+func parseListOptions(query url.Values) (cache.ListOptions, error) {
+	opts := cache.ListOptions{
+		Prefix:   query.Get("prefix"),
+		Contains: query.Get("contains"),
+		Sort:     strings.TrimPrefix(query.Get("sort"), "-"),
+		Cursor:   query.Get("cursor"),
+	}
+	opts.Descending = strings.HasPrefix(query.Get("sort"), "-")
+
+	if pattern := query.Get("regex"); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return opts, fmt.Errorf("invalid regex: %s", err)
+		}
+		opts.Regexp = re
+	}
+
+	if recordType := query.Get("type"); recordType != "" {
+		var ok bool
+		if opts.Type, _, ok = parseRecordType(recordType); !ok {
+			return opts, fmt.Errorf("record type %q is not one of A, AAAA", recordType)
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(limit); err != nil || opts.Limit < 0 {
+			return opts, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
+
+	return opts, nil
+}
+
+// GET /v1/cache: the cache entries, filtered, sorted and paged by the query params.
+// The body is a page of entries; the total count and the next page are in the headers.
+func (api *API) v1CacheList(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+
+	opts, err := parseListOptions(req.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	result, err := api.cache.List(opts)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(result.Total))
+	if result.Next != "" {
+		query := req.URL.Query()
+		query.Set("cursor", result.Next)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", req.URL.Path, query.Encode()))
+		w.Header().Set("X-Next-Cursor", result.Next)
+	}
+
+	writeJSON(w, http.StatusOK, result.Entries)
+}
+
+// GET, PUT or DELETE /v1/cache/{name}/{type}: a single cache entry
+func (api *API) v1CacheEntry(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	name := req.PathValue("name")
+	recordType, _, ok := parseRecordType(req.PathValue("type"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "record type %q is not one of A, AAAA", req.PathValue("type"))
+		return
+	}
+	key := cache.Key(name, recordType)
+
+	switch req.Method {
+	case http.MethodGet:
+		entry, ok := api.cache.GetEntry(key)
+		if !ok {
+			writeError(w, http.StatusNotFound, "no such record %s %s", name, recordType)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, entry.ToStringEntry())
+	case http.MethodPut:
+		var record CacheRecord
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&record); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON record: %s", err)
+			return
+		}
+
+		entry, status, err := api.putRecord(name, req.PathValue("type"), record)
+		if err != nil {
+			writeError(w, status, "%s", err)
+			return
+		}
+
+		writeJSON(w, status, entry)
+	case http.MethodDelete:
+		if !api.cache.Delete(key) {
+			writeError(w, http.StatusNotFound, "no such record %s %s", name, recordType)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Insert or replace a record and return it with 201 or 200,
+// or the error with the status of the failure
+func (api *API) putRecord(name string, typeParam string, record CacheRecord) (cache.StringEntry, int, error) {
+	recordType, qtype, ok := parseRecordType(typeParam)
+	if !ok {
+		return cache.StringEntry{}, http.StatusBadRequest, fmt.Errorf("record type %q is not one of A, AAAA", typeParam)
+	}
+
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return cache.StringEntry{}, http.StatusBadRequest, fmt.Errorf("%q is not a domain name", name)
+	}
+
+	ip := net.ParseIP(record.Value)
+	if ip == nil || (qtype == dns.TypeA) != (ip.To4() != nil) {
+		return cache.StringEntry{}, http.StatusBadRequest, fmt.Errorf("%q is not an address of type %s", record.Value, recordType)
+	}
+
+	if record.Ttl < 0 {
+		return cache.StringEntry{}, http.StatusBadRequest, fmt.Errorf("ttl must not be negative, got %d", record.Ttl)
+	}
+
+	// PUT replaces the existing entry, unless it is a static record
+	replaced, err := api.cache.ReplaceFromParams(name, record.Value, qtype, record.Ttl)
+	switch {
+	case errors.Is(err, cache.ErrStatic):
+		return cache.StringEntry{}, http.StatusConflict, fmt.Errorf("%s %s is a static record of the config", name, recordType)
+	case errors.Is(err, cache.ErrFull):
+		return cache.StringEntry{}, http.StatusInsufficientStorage, err
+	case err != nil:
+		return cache.StringEntry{}, http.StatusInternalServerError, err
+	}
+
+	status := http.StatusCreated
+	if replaced {
+		status = http.StatusOK
+	}
+
+	entry, _ := api.cache.GetEntry(cache.Key(name, recordType))
+	return entry.ToStringEntry(), status, nil
+}
+
+// POST /v1/cache/flush: delete the entries under a domain and/or of a type, or all of them
+func (api *API) v1CacheFlush(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodPost) {
+		return
+	}
+
+	var flush FlushRequest
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&flush); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid JSON flush request: %s", err)
+		return
+	}
+
+	filter := cache.PurgeFilter{Suffix: flush.Suffix}
+	if flush.Type != "" {
+		var ok bool
+		if filter.Type, _, ok = parseRecordType(flush.Type); !ok {
+			writeError(w, http.StatusBadRequest, "record type %q is not one of A, AAAA", flush.Type)
+			return
+		}
+	}
+
+	deleted, kept := api.cache.Purge(filter)
+	slog.Info("flushed the cache", "suffix", flush.Suffix, "type", flush.Type, "deleted", len(deleted))
+	writeJSON(w, http.StatusOK, FlushResult{Deleted: len(deleted), Entries: deleted, Kept: kept})
+}
+
+// POST /v1/cache/bulk: insert or replace many records; each one succeeds or fails on its own
+func (api *API) v1CacheBulk(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodPost) {
+		return
+	}
+
+	var records []BulkRecord
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&records); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON records: %s", err)
+		return
+	}
+
+	result := BulkResult{Results: make([]BulkRecordResult, 0, len(records))}
+	for _, record := range records {
+		_, status, err := api.putRecord(record.Name, record.Type, CacheRecord{Value: record.Value, Ttl: record.Ttl})
+		recordResult := BulkRecordResult{Name: record.Name, Type: record.Type, Status: status}
+
+		switch {
+		case err != nil:
+			recordResult.Message = err.Error()
+			result.Failed++
+		case status == http.StatusCreated:
+			result.Created++
+		default:
+			result.Replaced++
+		}
+		result.Results = append(result.Results, recordResult)
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// GET /v1/stats: the query statistics over the configured window
+func (api *API) v1Stats(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, api.server.Stats().Snapshot())
+}
+
+// GET /v1/upstreams: the upstream servers with their latencies
+func (api *API) v1Upstreams(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, api.upstreamStatuses())
+}
+
+// GET /v1/queries/stream: the handled queries as server-sent events
+func (api *API) v1QueryStream(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+
+	api.queryStream(w, req)
+}
+
+// GET or PUT /v1/config: the running config, or replace it with the JSON body.
+// The new config is validated, applied live and stored in the config file.
+func (api *API) v1Config(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet, http.MethodPut) {
+		return
+	}
+
+	if req.Method == http.MethodPut {
+		cfg := new(config.Config)
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON config: %s", err)
+			return
+		}
+
+		err := api.server.Update(cfg)
+		if errors.Is(err, server.ErrNotStored) {
+			// the new config is running, so the client mustn't roll it back
+			slog.Error("config update not stored", "err", err)
+			w.Header().Set("Warning", fmt.Sprintf("199 - %q", err.Error()))
+		} else if err != nil {
+			slog.Error("config update failed", "err", err)
+			writeError(w, http.StatusUnprocessableEntity, "config update failed: %s", err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, api.server.Config())
+}
+
+// POST /v1/config/reload: re-read the config file and apply it
+func (api *API) v1ConfigReload(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodPost) {
+		return
+	}
+
+	if err := api.server.Reload(); err != nil {
+		slog.Error("config reload failed", "err", err)
+		writeError(w, http.StatusUnprocessableEntity, "config reload failed: %s", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, api.server.Config())
+}
+
+// any other /v1 path
+func (api *API) v1NotFound(w http.ResponseWriter, req *http.Request) {
+	writeError(w, http.StatusNotFound, "no such resource %s", req.URL.Path)
+}
+
+// deprecated marks the responses of a pre-/v1 route as deprecated in favour of its successor
+func deprecated(successor string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		handler(w, req)
+	}
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dvlahovski/go-dnscached/cache"
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/server"
+	"github.com/dvlahovski/go-dnscached/test"
+)
+
+// Send a request to the handler and return the response
+func serve(handler http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestV1CacheEntry(t *testing.T) {
+	handler := getHandler(t, config.ApiConfig{})
+
+	w := serve(handler, http.MethodPut, "/v1/cache/example.bg/a", `{"Value": "1.2.3.4", "Ttl": 0}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("a new record should be created, got %d: %s", w.Code, w.Body)
+	}
+
+	w = serve(handler, http.MethodPut, "/v1/cache/example.bg/A", `{"Value": "4.3.2.1", "Ttl": 0}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("the record should be replaced, got %d: %s", w.Code, w.Body)
+	}
+
+	w = serve(handler, http.MethodGet, "/v1/cache/example.bg/A", "")
+	var entry cache.StringEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entry); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("the record should be returned, got %d: %s", w.Code, w.Body)
+	}
+
+	if entry.Key != "example.bg" || entry.Type != "A" || len(entry.Value) != 1 || entry.Value[0] != "4.3.2.1" {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	if w = serve(handler, http.MethodDelete, "/v1/cache/example.bg/A", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("the record should be deleted, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodGet, "/v1/cache/example.bg/A", "")
+	var apiErr Error
+	if err := json.Unmarshal(w.Body.Bytes(), &apiErr); err != nil || w.Code != http.StatusNotFound || apiErr.Status != http.StatusNotFound {
+		t.Fatalf("a missing record should be a JSON 404, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestV1Errors(t *testing.T) {
+	handler := getHandler(t, config.ApiConfig{})
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPut, "/v1/cache/example.bg/MX", `{"Value": "1.2.3.4"}`, http.StatusBadRequest},
+		{http.MethodPut, "/v1/cache/example.bg/AAAA", `{"Value": "1.2.3.4"}`, http.StatusBadRequest},
+		{http.MethodPut, "/v1/cache/example.bg/A", `{"Address": "1.2.3.4"}`, http.StatusBadRequest},
+		{http.MethodPost, "/v1/cache/example.bg/A", "", http.StatusMethodNotAllowed},
+		{http.MethodPut, "/v1/config", `{}`, http.StatusUnprocessableEntity},
+		{http.MethodGet, "/v1/nothing", "", http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		w := serve(handler, c.method, c.path, c.body)
+		if w.Code != c.status || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: expected a JSON %d, got %d %s", c.method, c.path, c.status, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestV1StaticRecord(t *testing.T) {
+	cfg := test.GetStubConfig()
+	cfg.Entries = []config.CacheEntry{{Key: "static.bg", Value: net.ParseIP("10.0.0.1"), Type: "A"}}
+	c := cache.NewCache(*cfg)
+	s, err := server.NewServer(c, cfg, new(test.StubDnsClient), &http.Client{})
+	if err != nil {
+		t.Fatalf("server creation error: %s", err)
+	}
+
+	apiServer, err := New(s, c, &cfg.Api, nil)
+	if err != nil {
+		t.Fatalf("API creation error: %s", err)
+	}
+
+	w := serve(apiServer.Handler, http.MethodPut, "/v1/cache/static.bg/A", `{"Value": "1.2.3.4"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("a static record should not be overwritten, got %d: %s", w.Code, w.Body)
+	}
+
+	entry, _ := c.GetEntry("static.bg.A.")
+	if value := entry.ToStringEntry().Value; len(value) != 1 || value[0] != "10.0.0.1" {
+		t.Fatalf("the static record should be kept, got %v", value)
+	}
+}
+
+func TestDeprecatedRoutes(t *testing.T) {
+	handler := getHandler(t, config.ApiConfig{})
+
+	w := serve(handler, http.MethodGet, "/cache/all", "")
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "true" {
+		t.Fatalf("the old routes should still work and be marked deprecated, got %d", w.Code)
+	}
+}
+
+func TestV1CacheListPaging(t *testing.T) {
+	handler := getHandler(t, config.ApiConfig{})
+	for _, name := range []string{"a.example.bg", "b.example.bg", "c.example.bg"} {
+		serve(handler, http.MethodPut, "/v1/cache/"+name+"/A", `{"Value": "1.2.3.4"}`)
+	}
+
+	w := serve(handler, http.MethodGet, "/v1/cache?contains=example&sort=-name&limit=2", "")
+	var entries []cache.StringEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil || len(entries) != 2 || entries[0].Key != "c.example.bg" {
+		t.Fatalf("expected the first page in descending order, got %d: %s", w.Code, w.Body)
+	}
+
+	if w.Header().Get("X-Total-Count") != "3" || !strings.Contains(w.Header().Get("Link"), `rel="next"`) {
+		t.Fatalf("expected the total and the next page, got %v", w.Header())
+	}
+
+	w = serve(handler, http.MethodGet, "/v1/cache?contains=example&sort=-name&limit=2&cursor="+w.Header().Get("X-Next-Cursor"), "")
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil || len(entries) != 1 || entries[0].Key != "a.example.bg" {
+		t.Fatalf("expected the last page, got %d: %s", w.Code, w.Body)
+	}
+
+	for _, query := range []string{"regex=(", "sort=size", "limit=-1", "type=MX", "cursor=broken"} {
+		if w := serve(handler, http.MethodGet, "/v1/cache?"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestV1CacheBulk(t *testing.T) {
+	handler := getHandler(t, config.ApiConfig{})
+	serve(handler, http.MethodPut, "/v1/cache/a.corp.bg/A", `{"Value": "1.2.3.4"}`)
+
+	w := serve(handler, http.MethodPost, "/v1/cache/bulk", `[
+		{"Name": "a.corp.bg", "Type": "A", "Value": "4.3.2.1"},
+		{"Name": "b.corp.bg", "Type": "aaaa", "Value": "::1", "Ttl": 60},
+		{"Name": "c.corp.bg", "Type": "A", "Value": "::1"}
+	]`)
+	var result BulkResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected the bulk result, got %d: %s", w.Code, w.Body)
+	}
+
+	if result.Created != 1 || result.Replaced != 1 || result.Failed != 1 || result.Results[2].Status != http.StatusBadRequest {
+		t.Fatalf("unexpected bulk result %+v", result)
+	}
+
+	w = serve(handler, http.MethodPost, "/v1/cache/flush", `{"Suffix": "corp.bg"}`)
+	var flush FlushResult
+	if err := json.Unmarshal(w.Body.Bytes(), &flush); err != nil || flush.Deleted != 2 {
+		t.Fatalf("expected 2 entries flushed, got %d: %s", w.Code, w.Body)
+	}
+
+	if w := serve(handler, http.MethodPost, "/v1/cache/flush", `{"Type": "MX"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("an invalid type should be rejected, got %d", w.Code)
+	}
+
+	// an empty body flushes everything
+	if w := serve(handler, http.MethodPost, "/v1/cache/flush", ""); w.Code != http.StatusOK {
+		t.Fatalf("an empty flush request should flush all, got %d: %s", w.Code, w.Body)
+	}
+}
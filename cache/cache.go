@@ -2,13 +2,16 @@ package cache
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/metrics"
 	"github.com/miekg/dns"
 )
 
@@ -55,6 +58,8 @@ func createPlaceholderMsg(key string, ip string, recordType uint16, ttl int) (*d
 
 // Entry is the cache's internal entry representation
 type Entry struct {
+	// the cache key, which names the question the entry answers
+	key   string
 	ttl   int
 	hits  int
 	Value dns.Msg
@@ -67,9 +72,14 @@ type Cache struct {
 	flushInterval int
 	lock          sync.Mutex
 	config        config.Config
+	static        map[string]struct{}
+	quit          chan struct{}
+	closed        bool
+	onClose       []func() error
 }
 
 // NewCache returns a new cache instance
+// The config is expected to have its defaults set
 func NewCache(cfg config.Config) *Cache {
 	c := new(Cache)
 	c.Entries = make(map[string]Entry)
@@ -77,19 +87,47 @@ func NewCache(cfg config.Config) *Cache {
 	c.config = cfg
 	c.capacity = cfg.Cache.MaxEntries
 	c.flushInterval = cfg.Cache.FlushInterval
+	c.static = make(map[string]struct{})
 
-	if c.capacity <= 0 {
-		log.Printf("bad capacity value in config, setting to 1000")
-		c.capacity = 1000
+	c.lock.Lock()
+	c.hardcodeRecords(cfg.Entries)
+	c.start()
+	c.lock.Unlock()
+
+	return c
+}
+
+// Reload applies a new config to the cache without dropping the cached entries.
+// The hardcoded records of the old config are replaced with the ones of the new config.
+// A closed cache is left as it is.
+func (c *Cache) Reload(cfg config.Config) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return
 	}
 
+	c.config = cfg
+	c.capacity = cfg.Cache.MaxEntries
+
+	for key := range c.static {
+		delete(c.Entries, key)
+	}
+	c.static = make(map[string]struct{})
+
 	c.hardcodeRecords(cfg.Entries)
 
-	c.start()
-	return c
+	if c.flushInterval != cfg.Cache.FlushInterval {
+		c.flushInterval = cfg.Cache.FlushInterval
+		c.stop()
+		c.start()
+	}
 }
 
-// Populate the cache with hardcoded records from the config
+// Populate the cache with hardcoded records from the config. They take the
+// place of cached ones with the same key and are kept even over the capacity.
+// The lock must be held.
 func (c *Cache) hardcodeRecords(entries []config.CacheEntry) {
 	for _, entry := range entries {
 		var recordType uint16
@@ -98,17 +136,19 @@ func (c *Cache) hardcodeRecords(entries []config.CacheEntry) {
 		} else if entry.Type == "AAAA" {
 			recordType = dns.TypeAAAA
 		} else {
-			log.Printf("skipping hardode entry")
+			slog.Warn("skipping hardcoded entry with unsupported type", "key", entry.Key, "type", entry.Type)
 			continue
 		}
 
 		msg, err := createPlaceholderMsg(entry.Key, entry.Value.String(), recordType, entry.Ttl)
 		if err != nil {
-			log.Printf("skipping hardode entry")
+			slog.Warn("skipping invalid hardcoded entry", "key", entry.Key, "err", err)
 			continue
 		}
 
-		c.Insert(dns.Fqdn(entry.Key)+entry.Type+".", *msg)
+		key := Key(entry.Key, entry.Type)
+		c.store(key, *msg)
+		c.static[key] = struct{}{}
 	}
 }
 
@@ -124,16 +164,21 @@ func (c *Cache) flush() {
 		}
 
 		if int64(entry.ttl) <= now {
-			log.Printf("deleting key %s", key)
+			slog.Debug("deleting expired key", "key", key)
 			delete(c.Entries, key)
+			metrics.CacheExpirations.Inc()
 		}
 	}
+
+	metrics.CacheSize.Set(float64(len(c.Entries)))
 }
 
-// Start the ticker that flushes every flushInterval seconds
+// Start the ticker that flushes every flushInterval seconds.
+// The lock must be held.
 func (c *Cache) start() {
 	ticker := time.NewTicker(time.Duration(c.flushInterval) * time.Second)
 	quit := make(chan struct{})
+	c.quit = quit
 	go func() {
 		for {
 			select {
@@ -147,10 +192,47 @@ func (c *Cache) start() {
 	}()
 }
 
+// Stop the flush ticker. The lock must be held.
+func (c *Cache) stop() {
+	close(c.quit)
+}
+
+// OnClose registers a hook run by Close after the flush ticker is stopped,
+// e.g. to write a snapshot of the cache
+func (c *Cache) OnClose(hook func() error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.onClose = append(c.onClose, hook)
+}
+
+// Close stops the flush ticker and runs the OnClose hooks.
+// It is safe to call more than once; only the first call does anything.
+func (c *Cache) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.stop()
+	hooks := c.onClose
+	c.lock.Unlock()
+
+	var errs []error
+	for _, hook := range hooks {
+		if err := hook(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
 // Insert a DNS msg in the cache
 func (c *Cache) Insert(key string, value dns.Msg) bool {
 	if len(value.Answer) <= 0 {
-		log.Printf("expecting at least one answer in the msg")
+		slog.Debug("expecting at least one answer in the msg", "key", key)
 		return false
 	}
 
@@ -162,10 +244,47 @@ func (c *Cache) Insert(key string, value dns.Msg) bool {
 	}
 
 	if _, ok := c.Entries[key]; ok {
-		log.Printf("cache item (%s) exists on insert", key)
+		slog.Debug("cache item exists on insert", "key", key)
 		return false
 	}
 
+	c.store(key, value)
+	return true
+}
+
+// the errors of Replace
+var (
+	ErrNoAnswer = errors.New("expecting at least one answer in the msg")
+	ErrStatic   = errors.New("static records can't be replaced")
+	ErrFull     = errors.New("the cache is full")
+)
+
+// Replace sets the DNS msg of a key in one step, whether it is cached or not,
+// and tells whether it was. The static records are never replaced.
+func (c *Cache) Replace(key string, value dns.Msg) (bool, error) {
+	if len(value.Answer) <= 0 {
+		return false, ErrNoAnswer
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.static[key]; ok {
+		return true, ErrStatic
+	}
+
+	_, replaced := c.Entries[key]
+	if !replaced && len(c.Entries) >= c.capacity {
+		return false, ErrFull
+	}
+
+	c.store(key, value)
+	return replaced, nil
+}
+
+// Store an entry for a DNS msg, expiring after its TTL but not before the
+// min TTL. The lock must be held.
+func (c *Cache) store(key string, value dns.Msg) {
 	entry := new(Entry)
 	ttl := calcTTL(value)
 	if ttl == 0 {
@@ -178,13 +297,35 @@ func (c *Cache) Insert(key string, value dns.Msg) bool {
 		entry.ttl = int(time.Now().Unix() + int64(ttl))
 	}
 
-	log.Printf("insert %s ttl %d", key, ttl)
+	slog.Debug("insert", "key", key, "ttl", ttl)
+	entry.key = key
 	entry.hits = 0
 	entry.Value = value
 
 	c.Entries[key] = *entry
+	metrics.CacheInserts.Inc()
+	metrics.CacheSize.Set(float64(len(c.Entries)))
+}
 
-	return true
+// Key returns the cache key of a domain name and record type, e.g. "google.bg.A."
+func Key(name string, recordType string) string {
+	return dns.Fqdn(name) + recordType + "."
+}
+
+// Get the name, without the trailing dot, and the record type of the question
+// an entry answers: from its cache key, or else from the question of its message
+func (e Entry) question() (string, string) {
+	key := strings.TrimSuffix(e.key, ".")
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+
+	if len(e.Value.Question) > 0 {
+		question := e.Value.Question[0]
+		return strings.TrimSuffix(question.Name, "."), dns.TypeToString[question.Qtype]
+	}
+
+	return "", ""
 }
 
 // InsertFromParams - insert and entry from separate params
@@ -194,14 +335,28 @@ func (c *Cache) InsertFromParams(key string, ip string, recordType uint16, ttl i
 		return false
 	}
 
-	recordTypeStr := ""
+	return c.Insert(Key(key, typeString(recordType)), *msg)
+}
+
+// ReplaceFromParams replaces an entry from separate params, see Replace
+func (c *Cache) ReplaceFromParams(key string, ip string, recordType uint16, ttl int) (bool, error) {
+	msg, err := createPlaceholderMsg(key, ip, recordType, ttl)
+	if err != nil {
+		return false, err
+	}
+
+	return c.Replace(Key(key, typeString(recordType)), *msg)
+}
+
+// Get the name of the A and AAAA record types, empty for the others
+func typeString(recordType uint16) string {
 	if recordType == dns.TypeA {
-		recordTypeStr = "A"
+		return "A"
 	} else if recordType == dns.TypeAAAA {
-		recordTypeStr = "AAAA"
+		return "AAAA"
 	}
 
-	return c.Insert(dns.Fqdn(key)+recordTypeStr+".", *msg)
+	return ""
 }
 
 // Get a DNS msg from the cache
@@ -211,9 +366,11 @@ func (c *Cache) Get(key string) (dns.Msg, bool) {
 
 	entry, ok := c.Entries[key]
 	if !ok {
+		metrics.CacheMisses.Inc()
 		return dns.Msg{}, false
 	}
 
+	metrics.CacheHits.Inc()
 	entry.hits++
 	c.Entries[key] = entry
 
@@ -222,6 +379,9 @@ func (c *Cache) Get(key string) (dns.Msg, bool) {
 
 // GetEntry returns the internal entry
 func (c *Cache) GetEntry(key string) (Entry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	entry, ok := c.Entries[key]
 	return entry, ok
 }
@@ -233,35 +393,93 @@ func (c *Cache) Delete(key string) bool {
 
 	_, ok := c.Entries[key]
 	delete(c.Entries, key)
+	delete(c.static, key)
+	if ok {
+		metrics.CacheEvictions.WithLabelValues(metrics.EvictionDelete).Inc()
+		metrics.CacheSize.Set(float64(len(c.Entries)))
+	}
+
 	return ok
 }
 
+// PurgeFilter selects the entries deleted by Purge; the zero value selects all of them
+type PurgeFilter struct {
+	// a domain name: the entries of the name and all its subdomains, case insensitive
+	Suffix string
+	// A or AAAA, empty for both
+	Type string
+}
+
+// Check if the question name and type of an entry match the filter
+func (f PurgeFilter) matches(entry Entry) bool {
+	name, recordType := entry.question()
+	name = strings.ToLower(name)
+	suffix := strings.TrimSuffix(strings.ToLower(f.Suffix), ".")
+	if suffix != "" && name != suffix && !strings.HasSuffix(name, "."+suffix) {
+		return false
+	}
+
+	return f.Type == "" || strings.EqualFold(f.Type, recordType)
+}
+
+// Purge deletes the entries matching the filter, except the hardcoded records of
+// the config, and returns the deleted entries and the number of kept hardcoded ones
+func (c *Cache) Purge(filter PurgeFilter) ([]StringEntry, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	deleted := []StringEntry{}
+	kept := 0
+	for key, entry := range c.Entries {
+		if !filter.matches(entry) {
+			continue
+		}
+
+		if _, ok := c.static[key]; ok {
+			kept++
+			continue
+		}
+
+		delete(c.Entries, key)
+		deleted = append(deleted, entry.ToStringEntry())
+		metrics.CacheEvictions.WithLabelValues(metrics.EvictionPurge).Inc()
+	}
+	metrics.CacheSize.Set(float64(len(c.Entries)))
+
+	sort.Slice(deleted, func(i, j int) bool {
+		if deleted[i].Key != deleted[j].Key {
+			return deleted[i].Key < deleted[j].Key
+		}
+		return deleted[i].Type < deleted[j].Type
+	})
+
+	return deleted, kept
+}
+
 type StringEntry struct {
 	Key   string
 	Value []string
 	Ttl   int
 	Type  string
+	Hits  int
 }
 
+// ToStringEntry returns the entry named by its question, so that the name and
+// type find it in the cache, with the addresses of its answers
 func (e Entry) ToStringEntry() StringEntry {
 	stringEntry := new(StringEntry)
-	var key string
-	var recordType string
 	for _, addr := range e.Value.Answer {
-		if addr.Header().Rrtype != dns.TypeA && addr.Header().Rrtype != dns.TypeAAAA {
-			continue
+		switch rr := addr.(type) {
+		case *dns.A:
+			stringEntry.Value = append(stringEntry.Value, rr.A.String())
+		case *dns.AAAA:
+			stringEntry.Value = append(stringEntry.Value, rr.AAAA.String())
 		}
-		addrStr := addr.String()
-		addrStr = strings.Replace(addrStr, "\t", " ", -1)
-		var ignore string
-		var ip string
-		fmt.Sscanf(addrStr, "%s %s IN %s %s", &key, &ignore, &recordType, &ip)
-		stringEntry.Value = append(stringEntry.Value, ip)
 	}
 
-	stringEntry.Key = key[:len(key)-1]
-	stringEntry.Type = recordType
+	stringEntry.Key, stringEntry.Type = e.question()
 	stringEntry.Ttl = e.ttl
+	stringEntry.Hits = e.hits
 
 	return *stringEntry
 }
@@ -270,11 +488,30 @@ func (e Entry) MarshalJSON() ([]byte, error) {
 	return json.Marshal(e.ToStringEntry())
 }
 
+// StringEntries returns all the entries of the cache, sorted by name and type
+func (c *Cache) StringEntries() []StringEntry {
+	c.lock.Lock()
+	entries := make([]StringEntry, 0, len(c.Entries))
+	for _, entry := range c.Entries {
+		entries = append(entries, entry.ToStringEntry())
+	}
+	c.lock.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Key != entries[j].Key {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Type < entries[j].Type
+	})
+
+	return entries
+}
+
 // MarshalJSON returns a json representation of the cache's contents
 func (c *Cache) MarshalJSON() ([]byte, error) {
 	var entries []StringEntry
-	for _, entry := range c.Entries {
-		entries = append(entries, entry.ToStringEntry())
+	for _, entry := range c.StringEntries() {
+		entries = append(entries, entry)
 	}
 
 	return json.Marshal(entries)
@@ -1,11 +1,19 @@
 package cache
 
 import (
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	configpkg "github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/metrics"
 	"github.com/dvlahovski/go-dnscached/test"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestCreation(t *testing.T) {
@@ -94,6 +102,32 @@ func TestInsertionFromParams(t *testing.T) {
 	}
 }
 
+func TestReplace(t *testing.T) {
+	config := test.GetStubConfig()
+	config.Cache.MaxEntries = 2
+	config.Entries = []configpkg.CacheEntry{{Key: "static.corp.bg", Value: net.ParseIP("10.0.0.1"), Type: "A"}}
+	cache := NewCache(*config)
+
+	replaced, err := cache.ReplaceFromParams("google.bg", "1.2.3.4", dns.TypeA, 120)
+	if err != nil || replaced {
+		t.Fatalf("a new entry should be inserted, got %t, %v", replaced, err)
+	}
+
+	replaced, err = cache.ReplaceFromParams("google.bg", "4.3.2.1", dns.TypeA, 120)
+	entry, _ := cache.GetEntry("google.bg.A.")
+	if err != nil || !replaced || entry.ToStringEntry().Value[0] != "4.3.2.1" {
+		t.Fatalf("the entry should be replaced, got %t, %v", replaced, err)
+	}
+
+	if _, err := cache.ReplaceFromParams("static.corp.bg", "1.2.3.4", dns.TypeA, 120); err != ErrStatic {
+		t.Fatalf("a static record should not be replaced, got %v", err)
+	}
+
+	if _, err := cache.ReplaceFromParams("dir.bg", "1.2.3.4", dns.TypeA, 120); err != ErrFull {
+		t.Fatalf("a new entry should not fit in a full cache, got %v", err)
+	}
+}
+
 func TestGetExisting(t *testing.T) {
 	var ok bool
 	config := test.GetStubConfig()
@@ -265,3 +299,336 @@ func TestToStringEntry(t *testing.T) {
 		t.Fatal("Type is incorrect")
 	}
 }
+
+func TestToStringEntryWithoutAddresses(t *testing.T) {
+	var entry Entry
+	entry.Value.SetQuestion("www.google.bg.", dns.TypeCNAME)
+	cname, _ := dns.NewRR("www.google.bg. 60 IN CNAME google.bg.")
+	entry.Value.Answer = []dns.RR{cname}
+
+	strEntry := entry.ToStringEntry()
+	if strEntry.Key != "www.google.bg" || strEntry.Type != "CNAME" || len(strEntry.Value) != 0 {
+		t.Fatalf("an entry without addresses should be named by its question, got %+v", strEntry)
+	}
+
+	if (Entry{}).ToStringEntry().Key != "" {
+		t.Fatal("an empty entry should have an empty key")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	config := test.GetStubConfig()
+	cache := NewCache(*config)
+	msg := test.GetDnsMsgAnswer()
+
+	hits := testutil.ToFloat64(metrics.CacheHits)
+	misses := testutil.ToFloat64(metrics.CacheMisses)
+	inserts := testutil.ToFloat64(metrics.CacheInserts)
+	evictions := testutil.ToFloat64(metrics.CacheEvictions.WithLabelValues(metrics.EvictionDelete))
+
+	cache.Get("google.bg")
+	cache.Insert("google.bg", *msg)
+	cache.Get("google.bg")
+	cache.Delete("google.bg")
+
+	if testutil.ToFloat64(metrics.CacheHits) != hits+1 {
+		t.Fatal("hits should be incremented")
+	}
+
+	if testutil.ToFloat64(metrics.CacheMisses) != misses+1 {
+		t.Fatal("misses should be incremented")
+	}
+
+	if testutil.ToFloat64(metrics.CacheInserts) != inserts+1 {
+		t.Fatal("inserts should be incremented")
+	}
+
+	if testutil.ToFloat64(metrics.CacheEvictions.WithLabelValues(metrics.EvictionDelete)) != evictions+1 {
+		t.Fatal("evictions should be incremented")
+	}
+
+	purges := testutil.ToFloat64(metrics.CacheEvictions.WithLabelValues(metrics.EvictionPurge))
+	cache.Insert("google.bg", *msg)
+	cache.Purge(PurgeFilter{})
+
+	if testutil.ToFloat64(metrics.CacheEvictions.WithLabelValues(metrics.EvictionPurge)) != purges+1 {
+		t.Fatal("purge evictions should be counted separately")
+	}
+	if testutil.ToFloat64(metrics.CacheEvictions.WithLabelValues(metrics.EvictionDelete)) != evictions+1 {
+		t.Fatal("a purge is not a delete")
+	}
+}
+
+func TestReload(t *testing.T) {
+	var ok bool
+	config := test.GetStubConfig()
+	config.Entries = []configpkg.CacheEntry{
+		{Key: "old.bg", Type: "A", Value: net.ParseIP("1.2.3.4")},
+	}
+	cache := NewCache(*config)
+	msg := test.GetDnsMsgAnswer()
+
+	ok = cache.Insert("google.bg", *msg)
+	if !ok {
+		t.Fatal("insertion failed")
+	}
+
+	reloaded := test.GetStubConfig()
+	reloaded.Cache.MaxEntries = 5
+	reloaded.Entries = []configpkg.CacheEntry{
+		{Key: "new.bg", Type: "A", Value: net.ParseIP("4.3.2.1")},
+	}
+	cache.Reload(*reloaded)
+
+	if cache.capacity != 5 {
+		t.Fatal("capacity should be updated")
+	}
+
+	if _, ok = cache.Get("google.bg"); !ok {
+		t.Fatal("cached entries should be kept")
+	}
+
+	if _, ok = cache.Get("old.bg.A."); ok {
+		t.Fatal("old hardcoded entries should be removed")
+	}
+
+	if _, ok = cache.Get("new.bg.A."); !ok {
+		t.Fatal("new hardcoded entries should be inserted")
+	}
+}
+
+func TestReloadFullCache(t *testing.T) {
+	config := test.GetStubConfig()
+	config.Cache.MaxEntries = 1
+	cache := NewCache(*config)
+	cache.InsertFromParams("google.bg", "1.2.3.4", dns.TypeA, 0)
+
+	reloaded := test.GetStubConfig()
+	reloaded.Cache.MaxEntries = 1
+	reloaded.Entries = []configpkg.CacheEntry{{Key: "static.bg", Type: "A", Value: net.ParseIP("4.3.2.1")}}
+	cache.Reload(*reloaded)
+
+	if _, ok := cache.Get("static.bg.A."); !ok {
+		t.Fatal("hardcoded entries should be inserted in a full cache")
+	}
+}
+
+func TestReloadAndClose(t *testing.T) {
+	cache := NewCache(*test.GetStubConfig())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			config := test.GetStubConfig()
+			config.Cache.FlushInterval = 10 + i
+			cache.Reload(*config)
+		}(i)
+		go func() {
+			defer wg.Done()
+			cache.Close()
+		}()
+	}
+	wg.Wait()
+
+	// a reload after close changing the flush interval is a no-op
+	config := test.GetStubConfig()
+	config.Cache.FlushInterval = 100
+	cache.Reload(*config)
+}
+
+func TestClose(t *testing.T) {
+	cache := NewCache(*test.GetStubConfig())
+
+	calls := 0
+	cache.OnClose(func() error {
+		calls++
+		return errors.New("snapshot failed")
+	})
+
+	if err := cache.Close(); err == nil {
+		t.Fatal("hook errors should be returned")
+	}
+
+	if err := cache.Close(); err != nil {
+		t.Fatal("closing again should do nothing")
+	}
+
+	if calls != 1 {
+		t.Fatalf("hook should be run once, got %d", calls)
+	}
+}
+
+func TestList(t *testing.T) {
+	config := test.GetStubConfig()
+	config.Entries = nil
+	cache := NewCache(*config)
+	for _, name := range []string{"b.example.bg", "a.example.bg", "c.test.bg"} {
+		cache.InsertFromParams(name, "1.2.3.4", dns.TypeA, 0)
+	}
+	cache.InsertFromParams("a.example.bg", "::1", dns.TypeAAAA, 60)
+	cache.Get("c.test.bg.A.")
+	cache.Get("c.test.bg.A.")
+	cache.Get("b.example.bg.A.")
+
+	names := func(entries []StringEntry) string {
+		var keys []string
+		for _, e := range entries {
+			keys = append(keys, e.Key+"/"+e.Type)
+		}
+		return strings.Join(keys, " ")
+	}
+
+	cases := []struct {
+		opts     ListOptions
+		expected string
+	}{
+		{ListOptions{}, "a.example.bg/A a.example.bg/AAAA b.example.bg/A c.test.bg/A"},
+		{ListOptions{Contains: "EXAMPLE", Type: "a"}, "a.example.bg/A b.example.bg/A"},
+		{ListOptions{Prefix: "c."}, "c.test.bg/A"},
+		{ListOptions{Regexp: regexp.MustCompile(`^[ab]\.`), Type: "AAAA"}, "a.example.bg/AAAA"},
+		{ListOptions{Sort: SortHits, Descending: true}, "c.test.bg/A b.example.bg/A a.example.bg/AAAA a.example.bg/A"},
+		{ListOptions{Sort: SortExpiry}, "a.example.bg/AAAA a.example.bg/A b.example.bg/A c.test.bg/A"},
+	}
+
+	for _, c := range cases {
+		result, err := cache.List(c.opts)
+		if err != nil {
+			t.Fatalf("%+v: %s", c.opts, err)
+		}
+		if got := names(result.Entries); got != c.expected {
+			t.Errorf("%+v: expected %q, got %q", c.opts, c.expected, got)
+		}
+	}
+
+	// page through by two, deleting the last entry of the first page in between
+	first, _ := cache.List(ListOptions{Limit: 2})
+	if first.Total != 4 || first.Next == "" || names(first.Entries) != "a.example.bg/A a.example.bg/AAAA" {
+		t.Fatalf("unexpected first page %+v", first)
+	}
+
+	cache.Delete("a.example.bg.AAAA.")
+	second, _ := cache.List(ListOptions{Limit: 2, Cursor: first.Next})
+	if second.Next != "" || names(second.Entries) != "b.example.bg/A c.test.bg/A" {
+		t.Fatalf("unexpected second page %+v", second)
+	}
+
+	if _, err := cache.List(ListOptions{Cursor: "broken"}); err == nil {
+		t.Fatal("an invalid cursor should fail")
+	}
+	if _, err := cache.List(ListOptions{Sort: "size"}); err == nil {
+		t.Fatal("an invalid order should fail")
+	}
+}
+
+func TestListCname(t *testing.T) {
+	cache := NewCache(*test.GetStubConfig())
+	cache.Insert(Key("www.example.com", "A"), cnameResponse())
+
+	result, err := cache.List(ListOptions{Prefix: "www.example.com"})
+	if err != nil || len(result.Entries) != 1 {
+		t.Fatalf("the entry should be listed by the name of its question, got %v, %v", result.Entries, err)
+	}
+
+	entry := result.Entries[0]
+	if entry.Key != "www.example.com" || entry.Type != "A" || len(entry.Value) != 1 || entry.Value[0] != "1.2.3.4" {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+	if _, ok := cache.GetEntry(Key(entry.Key, entry.Type)); !ok {
+		t.Fatal("the listed name and type should find the entry")
+	}
+
+	if result, _ := cache.List(ListOptions{Contains: "cdn"}); len(result.Entries) != 0 {
+		t.Fatalf("the name of the answer shouldn't match, got %v", result.Entries)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	config := test.GetStubConfig()
+	config.Entries = []configpkg.CacheEntry{{Key: "static.corp.bg", Value: net.ParseIP("10.0.0.1"), Type: "A"}}
+	cache := NewCache(*config)
+	for _, name := range []string{"corp.bg", "a.corp.bg", "notcorp.bg", "other.bg"} {
+		cache.InsertFromParams(name, "1.2.3.4", dns.TypeA, 0)
+	}
+	cache.InsertFromParams("b.corp.bg", "::1", dns.TypeAAAA, 0)
+
+	deleted, kept := cache.Purge(PurgeFilter{Suffix: "CORP.bg.", Type: "A"})
+	if len(deleted) != 2 || deleted[0].Key != "a.corp.bg" || deleted[1].Key != "corp.bg" || kept != 1 {
+		t.Fatalf("expected corp.bg and a.corp.bg deleted and the hardcoded record kept, got %v, %d", deleted, kept)
+	}
+
+	if _, ok := cache.GetEntry("b.corp.bg.AAAA."); !ok {
+		t.Fatal("other types should be kept")
+	}
+
+	deleted, kept = cache.Purge(PurgeFilter{})
+	if len(deleted) != 3 || kept != 1 || len(cache.Entries) != 1 {
+		t.Fatalf("expected all but the hardcoded record flushed, got %v, %d", deleted, kept)
+	}
+}
+
+// a response for www.example.com. A aliased to cdn.example.net.
+func cnameResponse() dns.Msg {
+	var msg dns.Msg
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	cname, _ := dns.NewRR("www.example.com. 60 IN CNAME cdn.example.net.")
+	a, _ := dns.NewRR("cdn.example.net. 60 IN A 1.2.3.4")
+	msg.Answer = []dns.RR{cname, a}
+	return msg
+}
+
+func TestPurgeCname(t *testing.T) {
+	cache := NewCache(*test.GetStubConfig())
+	cache.Insert(Key("www.example.com", "A"), cnameResponse())
+
+	if deleted, _ := cache.Purge(PurgeFilter{Suffix: "example.net"}); len(deleted) != 0 {
+		t.Fatalf("the name of the answer shouldn't match, got %v", deleted)
+	}
+
+	deleted, _ := cache.Purge(PurgeFilter{Suffix: "example.com", Type: "A"})
+	if len(deleted) != 1 || len(cache.Entries) != 0 {
+		t.Fatalf("the entry should be purged by the name of its question, got %v", deleted)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	config := test.GetStubConfig()
+	config.Entries = []configpkg.CacheEntry{{Key: "static.corp.bg", Value: net.ParseIP("10.0.0.1"), Type: "A"}}
+	cache := NewCache(*config)
+	defer cache.Close()
+
+	cache.InsertFromParams("a.bg", "1.2.3.4", dns.TypeA, 300)
+	cache.Get("a.bg.A.")
+	expired := test.GetDnsMsgAnswer()
+	cache.Entries["old.bg.A."] = Entry{ttl: int(time.Now().Unix()) - 1, Value: *expired}
+
+	path := t.TempDir() + "/cache.json"
+	if err := cache.WriteSnapshot(path); err != nil {
+		t.Fatalf("writing the snapshot failed: %s", err)
+	}
+
+	// the hardcoded records of the new config win
+	config.Entries[0].Value = net.ParseIP("10.0.0.2")
+	restoredCache := NewCache(*config)
+	defer restoredCache.Close()
+
+	restored, err := restoredCache.LoadSnapshot(path)
+	if err != nil || restored != 1 {
+		t.Fatalf("expected 1 restored entry, got %d, %v", restored, err)
+	}
+
+	entry, ok := restoredCache.GetEntry("a.bg.A.")
+	if !ok || entry.ToStringEntry().Value[0] != "1.2.3.4" || entry.hits != 1 {
+		t.Fatalf("expected the restored entry with its hits, got %v", entry.ToStringEntry())
+	}
+
+	entry, _ = restoredCache.GetEntry("static.corp.bg.A.")
+	if entry.ToStringEntry().Value[0] != "10.0.0.2" {
+		t.Fatalf("the snapshot should not replace hardcoded records, got %v", entry.ToStringEntry())
+	}
+
+	if restored, err := restoredCache.LoadSnapshot(path + ".missing"); err != nil || restored != 0 {
+		t.Fatalf("a missing snapshot should restore nothing, got %d, %v", restored, err)
+	}
+}
@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// the orders of List
+const (
+	SortName   = "name"
+	SortExpiry = "expiry"
+	SortHits   = "hits"
+)
+
+// ListOptions filters, sorts and pages the entries returned by List.
+// The zero value lists all the entries sorted by name.
+type ListOptions struct {
+	// the question names starting with Prefix or containing Contains, case insensitive
+	Prefix   string
+	Contains string
+	// names matching Regexp
+	Regexp *regexp.Regexp
+	// A or AAAA, empty for both
+	Type string
+	// one of SortName, SortExpiry or SortHits, ties are sorted by name and type;
+	// Descending reverses the whole order
+	Sort       string
+	Descending bool
+	// at most Limit entries, 0 for all
+	Limit int
+	// the Next of the previous page, empty for the first page
+	Cursor string
+}
+
+// ListResult is a page of the listed entries
+type ListResult struct {
+	Entries []StringEntry
+	// the number of entries matching the filters on all the pages
+	Total int
+	// the cursor of the next page, empty on the last page
+	Next string
+}
+
+// the position of an entry in the order of a listing, encoded in the cursors
+type position struct {
+	Value int64
+	Key   string
+	Type  string
+}
+
+func encodeCursor(p position) string {
+	jsonString, _ := json.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(jsonString)
+}
+
+func decodeCursor(cursor string) (position, error) {
+	var p position
+	jsonString, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(jsonString, &p)
+	}
+	if err != nil {
+		return p, fmt.Errorf("invalid cursor %q", cursor)
+	}
+
+	return p, nil
+}
+
+// Get the position of an entry when sorted by the given order
+func positionOf(entry StringEntry, order string) position {
+	p := position{Key: entry.Key, Type: entry.Type}
+	switch order {
+	case SortExpiry:
+		// permanent entries expire last
+		p.Value = int64(entry.Ttl)
+		if entry.Ttl == 0 {
+			p.Value = math.MaxInt64
+		}
+	case SortHits:
+		p.Value = int64(entry.Hits)
+	}
+
+	return p
+}
+
+// Check if a is before b in ascending order
+func (a position) before(b position) bool {
+	if a.Value != b.Value {
+		return a.Value < b.Value
+	}
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	return a.Type < b.Type
+}
+
+// Check if the name and type of an entry match the filters
+func (opts ListOptions) matches(entry StringEntry) bool {
+	name := strings.ToLower(entry.Key)
+	if opts.Prefix != "" && !strings.HasPrefix(name, strings.ToLower(opts.Prefix)) {
+		return false
+	}
+	if opts.Contains != "" && !strings.Contains(name, strings.ToLower(opts.Contains)) {
+		return false
+	}
+	if opts.Regexp != nil && !opts.Regexp.MatchString(entry.Key) {
+		return false
+	}
+
+	return opts.Type == "" || strings.EqualFold(opts.Type, entry.Type)
+}
+
+// List returns a page of the entries matching the filters of opts, in its order
+func (c *Cache) List(opts ListOptions) (ListResult, error) {
+	order := opts.Sort
+	if order == "" {
+		order = SortName
+	}
+	if order != SortName && order != SortExpiry && order != SortHits {
+		return ListResult{}, fmt.Errorf("invalid sort order %q", opts.Sort)
+	}
+
+	if opts.Limit < 0 {
+		return ListResult{}, fmt.Errorf("invalid limit %d", opts.Limit)
+	}
+
+	var after *position
+	if opts.Cursor != "" {
+		p, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return ListResult{}, err
+		}
+		after = &p
+	}
+
+	var entries []StringEntry
+	var positions []position
+	for _, entry := range c.StringEntries() {
+		if opts.matches(entry) {
+			entries = append(entries, entry)
+			positions = append(positions, positionOf(entry, order))
+		}
+	}
+
+	// in the listing order: is the i-th entry before p
+	isBefore := func(i int, p position) bool {
+		if opts.Descending {
+			return p.before(positions[i])
+		}
+		return positions[i].before(p)
+	}
+
+	sort.Sort(byPosition{entries, positions, opts.Descending})
+
+	result := ListResult{Total: len(entries), Entries: []StringEntry{}}
+	start := 0
+	if after != nil {
+		// the first entry after the cursor; the cursor entry itself may be gone
+		start = sort.Search(len(entries), func(i int) bool {
+			return !isBefore(i, *after) && positions[i] != *after
+		})
+	}
+
+	end := len(entries)
+	if opts.Limit > 0 && start+opts.Limit < end {
+		end = start + opts.Limit
+		result.Next = encodeCursor(positions[end-1])
+	}
+	result.Entries = append(result.Entries, entries[start:end]...)
+
+	return result, nil
+}
+
+// sorts the entries and their positions together
+type byPosition struct {
+	entries    []StringEntry
+	positions  []position
+	descending bool
+}
+
+func (s byPosition) Len() int { return len(s.entries) }
+
+func (s byPosition) Less(i, j int) bool {
+	if s.descending {
+		return s.positions[j].before(s.positions[i])
+	}
+	return s.positions[i].before(s.positions[j])
+}
+
+func (s byPosition) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+	s.positions[i], s.positions[j] = s.positions[j], s.positions[i]
+}
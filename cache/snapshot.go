@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/metrics"
+	"github.com/miekg/dns"
+)
+
+// snapshotEntry is a cache entry in a snapshot file
+type snapshotEntry struct {
+	Key string
+	// the unix time the entry expires at, 0 for never
+	Expires int
+	Hits    int
+	// the DNS message in wire format
+	Msg []byte
+}
+
+// WriteSnapshot writes the cached entries, without the hardcoded records of
+// the config, to a file that LoadSnapshot restores them from.
+// The file is replaced atomically so a failed write keeps the old snapshot.
+func (c *Cache) WriteSnapshot(path string) error {
+	c.lock.Lock()
+	entries := make([]snapshotEntry, 0, len(c.Entries))
+	for key, entry := range c.Entries {
+		if _, ok := c.static[key]; ok {
+			continue
+		}
+
+		msg, err := entry.Value.Pack()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, snapshotEntry{Key: key, Expires: entry.ttl, Hits: entry.hits, Msg: msg})
+	}
+	c.lock.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// LoadSnapshot restores the unexpired entries of a snapshot file and returns
+// how many were restored. The hardcoded records of the config are kept.
+// A missing file restores nothing.
+func (c *Cache) LoadSnapshot(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var entries []snapshotEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now().Unix()
+	restored := 0
+	for _, e := range entries {
+		if e.Expires != 0 && int64(e.Expires) <= now {
+			continue
+		}
+		if len(c.Entries) >= c.capacity {
+			break
+		}
+		if _, ok := c.Entries[e.Key]; ok {
+			continue
+		}
+
+		var msg dns.Msg
+		if err := msg.Unpack(e.Msg); err != nil {
+			continue
+		}
+
+		c.Entries[e.Key] = Entry{key: e.Key, ttl: e.Expires, hits: e.Hits, Value: msg}
+		restored++
+	}
+	metrics.CacheSize.Set(float64(len(c.Entries)))
+
+	return restored, nil
+}
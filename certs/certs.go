@@ -0,0 +1,160 @@
+// Package certs serves TLS certificates that are re-read when their files change
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/config"
+)
+
+// how often the files are checked for changes, at most
+const checkInterval = time.Second
+
+// Reloader holds a certificate, its key and an optional client CA loaded
+// from files and loads them again on the first handshake after the files change
+type Reloader struct {
+	cfg       config.TLSConfig
+	base      *tls.Config
+	lock      sync.Mutex
+	checked   time.Time
+	modTimes  map[string]time.Time
+	cert      tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// New loads the files of the TLS config
+func New(cfg config.TLSConfig) (*Reloader, error) {
+	r := &Reloader{cfg: cfg}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	r.base = &tls.Config{MinVersion: tls.VersionTLS12, GetConfigForClient: r.configForClient}
+	return r, nil
+}
+
+// Get the modification times of the files
+func (r *Reloader) stat() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	return modTimes, nil
+}
+
+// Read the files; the lock must be held or r not yet shared
+func (r *Reloader) load() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.cert = cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	r.checked = time.Now()
+	return nil
+}
+
+// Reload the files if they changed since they were loaded.
+// On failure the loaded certificate is kept.
+func (r *Reloader) reloadIfChanged() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if time.Since(r.checked) < checkInterval {
+		return
+	}
+	r.checked = time.Now()
+
+	modTimes, err := r.stat()
+	if err != nil {
+		slog.Warn("could not check the TLS files", "cert", r.cfg.CertFile, "err", err)
+		return
+	}
+
+	changed := false
+	for file, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[file]) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	if err := r.load(); err != nil {
+		slog.Error("TLS certificate reload failed, keeping the old one", "cert", r.cfg.CertFile, "err", err)
+		return
+	}
+	slog.Info("reloaded TLS certificate", "cert", r.cfg.CertFile)
+}
+
+// Get the TLS config of a handshake with the current certificate
+func (r *Reloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.reloadIfChanged()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	cfg := r.base.Clone()
+	cfg.GetConfigForClient = nil
+	cfg.Certificates = []tls.Certificate{r.cert}
+	if r.clientCAs != nil {
+		cfg.ClientCAs = r.clientCAs
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// ClientCertificate presents the current certificate as a client certificate,
+// for use as the GetClientCertificate of a client TLS config
+func (r *Reloader) ClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.reloadIfChanged()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	cert := r.cert
+	return &cert, nil
+}
+
+// TLSConfig returns the TLS config for a server, picking up the changed files on new connections
+func (r *Reloader) TLSConfig() *tls.Config {
+	return r.base
+}
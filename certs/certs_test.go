@@ -0,0 +1,80 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/test"
+)
+
+func servedName(t *testing.T, r *Reloader) string {
+	cfg, err := r.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf.Subject.CommonName
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	cfg := test.WriteCert(t, dir, "first")
+
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatalf("loading failed: %s", err)
+	}
+
+	if name := servedName(t, r); name != "first" {
+		t.Fatalf("expected the first certificate, got %s", name)
+	}
+
+	test.WriteCert(t, dir, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(cfg.CertFile, later, later)
+	os.Chtimes(cfg.KeyFile, later, later)
+	r.checked = time.Time{}
+
+	if name := servedName(t, r); name != "second" {
+		t.Fatalf("the changed certificate should be reloaded, got %s", name)
+	}
+
+	// a broken file keeps the loaded certificate
+	os.WriteFile(cfg.KeyFile, []byte("broken"), 0600)
+	evenLater := later.Add(time.Minute)
+	os.Chtimes(cfg.KeyFile, evenLater, evenLater)
+	r.checked = time.Time{}
+
+	if name := servedName(t, r); name != "second" {
+		t.Fatalf("a failed reload should keep the old certificate, got %s", name)
+	}
+}
+
+func TestClientCA(t *testing.T) {
+	cfg := test.WriteCert(t, t.TempDir(), "server")
+	cfg.ClientCAFile = cfg.CertFile
+
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatalf("loading failed: %s", err)
+	}
+
+	serverCfg, _ := r.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if serverCfg.ClientAuth != tls.RequireAndVerifyClientCert || serverCfg.ClientCAs == nil {
+		t.Fatal("a client CA should require verified client certificates")
+	}
+
+	cfg.ClientCAFile = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := New(cfg); err == nil {
+		t.Fatal("a missing client CA should fail")
+	}
+}
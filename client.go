@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/api"
+	"github.com/dvlahovski/go-dnscached/cache"
+	"github.com/dvlahovski/go-dnscached/client"
+	"github.com/dvlahovski/go-dnscached/stats"
+)
+
+// apiFlags are the flags of the commands calling the daemon's REST API
+type apiFlags struct {
+	address  *string
+	token    *string
+	caFile   *string
+	certFile *string
+	keyFile  *string
+}
+
+func newApiFlags(flags *flag.FlagSet) apiFlags {
+	defaultAddress := os.Getenv("DNSCACHED_API_ADDRESS")
+	if defaultAddress == "" {
+		defaultAddress = "localhost:8282"
+	}
+
+	return apiFlags{
+		address:  flags.String("api", defaultAddress, "address of the daemon's REST API, https://host:port if it serves TLS"),
+		token:    flags.String("token", os.Getenv("DNSCACHED_API_TOKEN"), "bearer token for the REST API"),
+		caFile:   flags.String("cacert", os.Getenv("DNSCACHED_API_CACERT"), "CA certificate file to verify the API certificate with"),
+		certFile: flags.String("cert", os.Getenv("DNSCACHED_API_CERT"), "client certificate file, if the API requires one"),
+		keyFile:  flags.String("key", os.Getenv("DNSCACHED_API_KEY"), "client key file"),
+	}
+}
+
+// Get the client of the API of the parsed flags and its base URL
+func (f apiFlags) client() (*client.Client, string) {
+	baseURL := *f.address
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		baseURL = "http://" + baseURL
+	}
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	if strings.HasPrefix(baseURL, "https://") {
+		tlsConfig, err := client.TLSConfig(*f.caFile, *f.certFile, *f.keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(2)
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	return client.New(baseURL, *f.token, httpClient), baseURL
+}
+
+// Parse the common client flags and return the API client and the remaining args
+func newApiClient(name string, args []string) (*client.Client, []string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	apiFlags := newApiFlags(flags)
+	flags.Parse(args)
+
+	c, _ := apiFlags.client()
+	return c, flags.Args()
+}
+
+func formatExpiry(timestamp int) string {
+	if timestamp == 0 {
+		return "never"
+	}
+
+	return time.Unix(int64(timestamp), 0).Format(time.DateTime)
+}
+
+func printEntries(entries []cache.StringEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tEXPIRES\tVALUES")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", entry.Key, entry.Type, formatExpiry(entry.Ttl), strings.Join(entry.Value, ", "))
+	}
+	w.Flush()
+}
+
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	return 1
+}
+
+const cacheUsage = `usage: go-dnscached cache [-api address] [-token token] [-cacert file] [-cert file -key file] <command>
+
+commands:
+  list                          list all the cache entries
+  get <name> <type>             show a cache entry
+  delete <name> <type>          delete a cache entry
+  insert <name> <type> <ip> [ttl]
+                                insert an entry, ttl in seconds (0 for permanent)
+  flush [domain] [type]         delete the entries of a domain and its subdomains and/or
+                                of a type, or all the entries; hardcoded records are kept
+  import <file>                 insert or replace the records in a JSON file (- for stdin):
+                                [{"Name": "a.bg", "Type": "A", "Value": "1.2.3.4", "Ttl": 0}]
+`
+
+// cache: list and edit the cache of the running daemon
+func cacheCommand(args []string) int {
+	c, args := newApiClient("cache", args)
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cacheUsage)
+		return 2
+	}
+	ctx := context.Background()
+
+	command, args := args[0], args[1:]
+	switch {
+	case command == "list" && len(args) == 0:
+		entries, err := c.CacheEntries(ctx)
+		if err != nil {
+			return fail(err)
+		}
+		printEntries(entries)
+	case command == "get" && len(args) == 2:
+		entry, err := c.CacheEntry(ctx, args[0], args[1])
+		if err != nil {
+			return fail(err)
+		}
+		printEntries([]cache.StringEntry{entry})
+	case command == "delete" && len(args) == 2:
+		if err := c.DeleteCacheEntry(ctx, args[0], args[1]); err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Deleted %s %s\n", args[0], args[1])
+	case command == "insert" && (len(args) == 3 || len(args) == 4):
+		record := api.CacheRecord{Value: args[2]}
+		if len(args) == 4 {
+			ttl, err := strconv.Atoi(args[3])
+			if err != nil {
+				return fail(fmt.Errorf("invalid ttl %q", args[3]))
+			}
+			record.Ttl = ttl
+		}
+		if _, err := c.PutCacheEntry(ctx, args[0], args[1], record); err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Inserted %s %s %s\n", args[0], args[1], args[2])
+	case command == "flush" && len(args) <= 2:
+		var flush api.FlushRequest
+		for _, arg := range args {
+			if strings.EqualFold(arg, "A") || strings.EqualFold(arg, "AAAA") {
+				flush.Type = arg
+			} else {
+				flush.Suffix = arg
+			}
+		}
+
+		result, err := c.FlushCache(ctx, flush)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Flushed %d entries\n", result.Deleted)
+		if result.Kept > 0 {
+			fmt.Printf("Kept %d hardcoded records\n", result.Kept)
+		}
+	case command == "import" && len(args) == 1:
+		return importRecords(ctx, c, args[0])
+	default:
+		fmt.Fprint(os.Stderr, cacheUsage)
+		return 2
+	}
+
+	return 0
+}
+
+// Insert the records of a JSON file and print the failures
+func importRecords(ctx context.Context, c *client.Client, file string) int {
+	var contents []byte
+	var err error
+	if file == "-" {
+		contents, err = io.ReadAll(os.Stdin)
+	} else {
+		contents, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	var records []api.BulkRecord
+	if err := json.Unmarshal(contents, &records); err != nil {
+		return fail(fmt.Errorf("invalid records in %s: %w", file, err))
+	}
+
+	result, err := c.BulkInsert(ctx, records)
+	if err != nil {
+		return fail(err)
+	}
+
+	for _, r := range result.Results {
+		if r.Message != "" {
+			fmt.Fprintf(os.Stderr, "%s %s: %s\n", r.Name, r.Type, r.Message)
+		}
+	}
+	fmt.Printf("Created %d, replaced %d, failed %d\n", result.Created, result.Replaced, result.Failed)
+
+	if result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printCounts(title string, counts []stats.Count) {
+	fmt.Printf("\n%s\n", title)
+	for _, count := range counts {
+		fmt.Printf("  %8d  %s\n", count.Count, count.Key)
+	}
+}
+
+// stats: show the query statistics of the running daemon
+func statsCommand(args []string) int {
+	c, _ := newApiClient("stats", args)
+
+	snapshot, err := c.Stats(context.Background())
+	if err != nil {
+		return fail(err)
+	}
+
+	fmt.Printf("Last %d seconds: %d queries, %d hits, %d misses, %.1f%% hit ratio\n",
+		snapshot.Window, snapshot.Queries, snapshot.Hits, snapshot.Misses, snapshot.HitRatio*100)
+	printCounts("Top domains", snapshot.TopDomains)
+	printCounts("Top clients", snapshot.TopClients)
+	printCounts("Top NXDOMAIN", snapshot.TopNXDomain)
+
+	return 0
+}
+
+// upstreams: show the upstream servers of the running daemon and their latencies
+func upstreamsCommand(args []string) int {
+	c, _ := newApiClient("upstreams", args)
+
+	upstreams, err := c.Upstreams(context.Background())
+	if err != nil {
+		return fail(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "UPSTREAM\tPROTOCOL\tREQUESTS\tERRORS\tAVG MS\tMAX MS")
+	for _, u := range upstreams {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.2f\t%.2f\n", u.Upstream.Upstream, u.Protocol, u.Requests, u.Errors, u.AvgMillis, u.MaxMillis)
+	}
+	w.Flush()
+
+	return 0
+}
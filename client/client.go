@@ -0,0 +1,340 @@
+// Package client is a typed client of the /v1 REST API, as described by /openapi.json
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/api"
+	"github.com/dvlahovski/go-dnscached/cache"
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/logging"
+	"github.com/dvlahovski/go-dnscached/stats"
+)
+
+// Error is an error response of the API
+type Error api.Error
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// Client talks to the REST API of a running daemon
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// New returns a client of the API at baseURL, e.g. http://localhost:8282.
+// The token is sent as a bearer token if not empty. A nil httpClient
+// is replaced by one with a 15 second timeout.
+func New(baseURL string, token string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 15 * time.Second}
+	}
+
+	return &Client{baseURL: strings.TrimSuffix(baseURL, "/"), token: token, http: httpClient}
+}
+
+// TLSConfig returns a client TLS config trusting the system CAs and the
+// certificates in caFile, and presenting certFile and keyFile if set.
+// Empty files are skipped.
+func TLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+
+	tlsConfig := &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Send a request with the JSON of in as the body, if not nil, and
+// decode the JSON response in out, if not nil
+func (c *Client) do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		jsonString, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(jsonString)
+	}
+
+	res, err := c.send(ctx, c.http, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// Send a request and return the response if its status is 2xx
+func (c *Client) send(ctx context.Context, httpClient *http.Client, method string, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+
+	contents, _ := io.ReadAll(res.Body)
+	apiErr := &Error{Status: res.StatusCode}
+	if json.Unmarshal(contents, apiErr) != nil || apiErr.Message == "" {
+		apiErr.Status = res.StatusCode
+		apiErr.Message = strings.TrimSpace(string(contents))
+	}
+
+	return nil, apiErr
+}
+
+// Get the path of a cache entry
+func entryPath(name string, recordType string) string {
+	return "/v1/cache/" + url.PathEscape(name) + "/" + url.PathEscape(recordType)
+}
+
+// CacheQuery filters, sorts and pages a cache listing; see the query params of GET /v1/cache
+type CacheQuery struct {
+	Prefix   string
+	Contains string
+	Regex    string
+	Type     string
+	// name, expiry or hits, with a - prefix for descending order
+	Sort   string
+	Limit  int
+	Cursor string
+}
+
+// CachePage is a page of a cache listing
+type CachePage struct {
+	Entries []cache.StringEntry
+	// the number of matching entries on all the pages
+	Total int
+	// the Cursor of the next page, empty on the last page
+	Next string
+}
+
+// CacheEntries returns all the cache entries
+func (c *Client) CacheEntries(ctx context.Context) ([]cache.StringEntry, error) {
+	var entries []cache.StringEntry
+	err := c.do(ctx, http.MethodGet, "/v1/cache", nil, &entries)
+	return entries, err
+}
+
+// ListCache returns a page of the cache entries matching the query
+func (c *Client) ListCache(ctx context.Context, q CacheQuery) (CachePage, error) {
+	query := url.Values{}
+	for param, value := range map[string]string{
+		"prefix": q.Prefix, "contains": q.Contains, "regex": q.Regex,
+		"type": q.Type, "sort": q.Sort, "cursor": q.Cursor,
+	} {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+	if q.Limit > 0 {
+		query.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	var page CachePage
+	res, err := c.send(ctx, c.http, http.MethodGet, "/v1/cache?"+query.Encode(), nil)
+	if err != nil {
+		return page, err
+	}
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(res.Body).Decode(&page.Entries); err != nil {
+		return page, err
+	}
+	page.Total, _ = strconv.Atoi(res.Header.Get("X-Total-Count"))
+	page.Next = res.Header.Get("X-Next-Cursor")
+
+	return page, nil
+}
+
+// CacheEntry returns the cache entry of a name and record type, A or AAAA
+func (c *Client) CacheEntry(ctx context.Context, name string, recordType string) (cache.StringEntry, error) {
+	var entry cache.StringEntry
+	err := c.do(ctx, http.MethodGet, entryPath(name, recordType), nil, &entry)
+	return entry, err
+}
+
+// PutCacheEntry inserts or replaces a cache entry and returns it
+func (c *Client) PutCacheEntry(ctx context.Context, name string, recordType string, record api.CacheRecord) (cache.StringEntry, error) {
+	var entry cache.StringEntry
+	err := c.do(ctx, http.MethodPut, entryPath(name, recordType), record, &entry)
+	return entry, err
+}
+
+// DeleteCacheEntry deletes a cache entry
+func (c *Client) DeleteCacheEntry(ctx context.Context, name string, recordType string) error {
+	return c.do(ctx, http.MethodDelete, entryPath(name, recordType), nil, nil)
+}
+
+// FlushCache deletes the entries matching the request, all of them for an empty request
+func (c *Client) FlushCache(ctx context.Context, flush api.FlushRequest) (api.FlushResult, error) {
+	var result api.FlushResult
+	err := c.do(ctx, http.MethodPost, "/v1/cache/flush", flush, &result)
+	return result, err
+}
+
+// BulkInsert inserts or replaces many records and returns the outcome of each one
+func (c *Client) BulkInsert(ctx context.Context, records []api.BulkRecord) (api.BulkResult, error) {
+	var result api.BulkResult
+	err := c.do(ctx, http.MethodPost, "/v1/cache/bulk", records, &result)
+	return result, err
+}
+
+// Stats returns the query statistics
+func (c *Client) Stats(ctx context.Context) (stats.Snapshot, error) {
+	var snapshot stats.Snapshot
+	err := c.do(ctx, http.MethodGet, "/v1/stats", nil, &snapshot)
+	return snapshot, err
+}
+
+// Upstreams returns the upstream servers with their latencies
+func (c *Client) Upstreams(ctx context.Context) ([]api.UpstreamStatus, error) {
+	var upstreams []api.UpstreamStatus
+	err := c.do(ctx, http.MethodGet, "/v1/upstreams", nil, &upstreams)
+	return upstreams, err
+}
+
+// Config returns the running config
+func (c *Client) Config(ctx context.Context) (*config.Config, error) {
+	cfg := new(config.Config)
+	if err := c.do(ctx, http.MethodGet, "/v1/config", nil, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// PutConfig validates, applies and stores a new config and returns the running one
+func (c *Client) PutConfig(ctx context.Context, cfg *config.Config) (*config.Config, error) {
+	applied := new(config.Config)
+	if err := c.do(ctx, http.MethodPut, "/v1/config", cfg, applied); err != nil {
+		return nil, err
+	}
+
+	return applied, nil
+}
+
+// ReloadConfig makes the daemon re-read its config file and returns the running config
+func (c *Client) ReloadConfig(ctx context.Context) (*config.Config, error) {
+	applied := new(config.Config)
+	if err := c.do(ctx, http.MethodPost, "/v1/config/reload", nil, applied); err != nil {
+		return nil, err
+	}
+
+	return applied, nil
+}
+
+// Queries calls handle with every query handled by the daemon, for names
+// containing filter if not empty, until ctx is done, the stream ends or handle fails
+func (c *Client) Queries(ctx context.Context, filter string, handle func(logging.QueryEntry) error) error {
+	// the stream never ends by itself, so it can't have a timeout
+	streamClient := *c.http
+	streamClient.Timeout = 0
+
+	path := "/v1/queries/stream"
+	if filter != "" {
+		path += "?" + url.Values{"filter": {filter}}.Encode()
+	}
+
+	res, err := c.send(ctx, &streamClient, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var query logging.QueryEntry
+		if err := json.Unmarshal([]byte(data), &query); err != nil {
+			return err
+		}
+		if err := handle(query); err != nil {
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return scanner.Err()
+}
+
+// Proxy returns a handler passing the requests on to the API with their own
+// credentials, never the token of the client, so that a web page calls the
+// API with the scope of its user
+func (c *Client) Proxy() (http.Handler, error) {
+	target, err := url.Parse(c.baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.Out.Header.Del("Cookie")
+		},
+		Transport: c.http.Transport,
+	}, nil
+}
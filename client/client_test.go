@@ -0,0 +1,164 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/api"
+	"github.com/dvlahovski/go-dnscached/cache"
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/logging"
+	"github.com/dvlahovski/go-dnscached/server"
+	"github.com/dvlahovski/go-dnscached/test"
+)
+
+// Start an API server with a stub DNS client and return a client of it
+func newTestClient(t *testing.T) *Client {
+	return newTestClientWithToken(t, "")
+}
+
+// Start an API server accepting only the given admin token, if not empty,
+// and return a client of it with the token
+func newTestClientWithToken(t *testing.T, token string) *Client {
+	client, _ := newTestServer(t, token)
+	return client
+}
+
+// Start an API server accepting only the given admin token, if not empty,
+// and return a client of it with the token and its DNS server
+func newTestServer(t *testing.T, token string) (*Client, *server.Server) {
+	cfg := test.GetStubConfig()
+	if token != "" {
+		cfg.Api.Tokens = []config.TokenConfig{{Token: token, Scope: config.ScopeAdmin}}
+	}
+	cfg.SetDefaults()
+
+	c := cache.NewCache(*cfg)
+	s, err := server.NewServer(c, cfg, new(test.StubDnsClient), &http.Client{})
+	if err != nil {
+		t.Fatalf("server creation error: %s", err)
+	}
+
+	apiServer, err := api.New(s, c, &cfg.Api, nil)
+	if err != nil {
+		t.Fatalf("API creation error: %s", err)
+	}
+
+	ts := httptest.NewServer(apiServer.Handler)
+	t.Cleanup(ts.Close)
+
+	return New(ts.URL, token, ts.Client()), s
+}
+
+func TestCacheEntries(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	entry, err := client.PutCacheEntry(ctx, "example.bg", "a", api.CacheRecord{Value: "1.2.3.4"})
+	if err != nil {
+		t.Fatalf("insert failed: %s", err)
+	}
+	if entry.Key != "example.bg" || entry.Type != "A" {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	entries, err := client.CacheEntries(ctx)
+	if err != nil || len(entries) == 0 {
+		t.Fatalf("expected the entries, got %v, %s", entries, err)
+	}
+
+	if err := client.DeleteCacheEntry(ctx, "example.bg", "A"); err != nil {
+		t.Fatalf("delete failed: %s", err)
+	}
+
+	_, err = client.CacheEntry(ctx, "example.bg", "A")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusNotFound {
+		t.Fatalf("expected a 404 error, got %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	if _, err := client.Stats(ctx); err != nil {
+		t.Fatalf("stats failed: %s", err)
+	}
+
+	upstreams, err := client.Upstreams(ctx)
+	if err != nil || len(upstreams) == 0 {
+		t.Fatalf("expected the upstreams, got %v, %s", upstreams, err)
+	}
+
+	if _, err := client.Config(ctx); err != nil {
+		t.Fatalf("config failed: %s", err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	client := newTestClientWithToken(t, "secret")
+	proxy, err := client.Proxy()
+	if err != nil {
+		t.Fatalf("proxy creation error: %s", err)
+	}
+
+	ts := httptest.NewServer(proxy)
+	t.Cleanup(ts.Close)
+
+	for token, status := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "secret": http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/v1/stats", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("request through the proxy failed: %s", err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != status {
+			t.Errorf("the proxy should pass on the credentials of the request %q, expected %d, got %d", token, status, res.StatusCode)
+		}
+	}
+}
+
+func TestQueries(t *testing.T) {
+	client, s := newTestServer(t, "")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msg := test.GetDnsMsgQuestion()
+	go func() {
+		// keep querying until the stream is subscribed and gets one
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.HandleRequest(new(test.StubResponseWriter), msg.Copy())
+			}
+		}
+	}()
+
+	var got logging.QueryEntry
+	done := errors.New("done")
+	err := client.Queries(ctx, "", func(query logging.QueryEntry) error {
+		got = query
+		return done
+	})
+	if err != done {
+		t.Fatalf("expected a query from the stream, got %v", err)
+	}
+
+	if got.Name != msg.Question[0].Name || got.Type != "A" || got.Rcode == "" {
+		t.Fatalf("unexpected query %+v", got)
+	}
+}
@@ -1,11 +1,10 @@
 package config
 
 import (
-	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"os"
+	"path/filepath"
 )
 
 // PolicyDefault is the default caching policy
@@ -14,28 +13,98 @@ const PolicyDefault = "default"
 // PolicyKeepMostUsed TODO
 const PolicyKeepMostUsed = "keep-most-used"
 
+// Formats of the daemon and query logs
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Levels of the daemon log
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+// Protocols the DNS server listens with
+const (
+	ListenerUDP = "udp"
+	ListenerTCP = "tcp"
+	ListenerDoT = "dot"
+	ListenerDoH = "doh"
+)
+
 // Config is the layout struct of the JSON config
 type Config struct {
-	Server  ServerConfig `json:"Server"`
-	Cache   CacheConfig  `json:"Cache"`
-	Entries []CacheEntry `json:"CacheEntries"`
-	Web     WebConfig    `json:"Web"`
-	Api     ApiConfig    `json:"Api"`
+	Server     ServerConfig     `json:"Server"`
+	Cache      CacheConfig      `json:"Cache"`
+	Entries    []CacheEntry     `json:"CacheEntries"`
+	Web        WebConfig        `json:"Web"`
+	Api        ApiConfig        `json:"Api"`
+	Stats      StatsConfig      `json:"Stats"`
+	Log        LogConfig        `json:"Log"`
+	QueryLog   QueryLogConfig   `json:"QueryLog"`
+	Dnstap     DnstapConfig     `json:"Dnstap"`
+	Privileges PrivilegesConfig `json:"Privileges"`
+
+	path   string
+	origin *origin
 }
 
 // ServerConfig is the server specific configuration
+// Address is a UDP address to listen on, in addition to the Listeners.
+// ShutdownTimeout is how many seconds in-flight requests are given to finish on shutdown.
 type ServerConfig struct {
-	Address      string   `json:"Address"`
-	Servers      []string `json:"Servers"`
-	ServersHTTPS []string `json:"ServersHTTPS"`
+	Address         string           `json:"Address"`
+	Listeners       []ListenerConfig `json:"Listeners"`
+	Servers         []string         `json:"Servers"`
+	ServersHTTPS    []string         `json:"ServersHTTPS"`
+	ShutdownTimeout int              `json:"ShutdownTimeout"`
+	Edns            EdnsConfig       `json:"Edns"`
+}
+
+// EdnsConfig is the EDNS0 handling of the DNS server. UDPSize is the UDP
+// payload size offered to the clients and the upstreams. The options with a
+// code in ForwardOptions (e.g. 8 for client subnet) are passed from the clients
+// to the upstreams and back, all the others are stripped.
+type EdnsConfig struct {
+	UDPSize        int   `json:"UDPSize"`
+	ForwardOptions []int `json:"ForwardOptions"`
+}
+
+// ListenerConfig is an address the DNS server listens on with one of the
+// udp, tcp, dot (DNS over TLS) or doh (DNS over HTTPS) protocols.
+// With Interface set, the server listens on all the addresses of the
+// interface at the port of Address, e.g. ":53".
+// CertFile and KeyFile are required by dot and doh; Path is the doh url path.
+type ListenerConfig struct {
+	Address   string `json:"Address"`
+	Protocol  string `json:"Protocol"`
+	Interface string `json:"Interface,omitempty"`
+	CertFile  string `json:"CertFile,omitempty"`
+	KeyFile   string `json:"KeyFile,omitempty"`
+	Path      string `json:"Path,omitempty"`
+}
+
+// AllListeners returns the Listeners, preceded by a UDP listener on Address if it is set
+func (s ServerConfig) AllListeners() []ListenerConfig {
+	if s.Address == "" {
+		return s.Listeners
+	}
+
+	return append([]ListenerConfig{{Address: s.Address, Protocol: ListenerUDP}}, s.Listeners...)
 }
 
 // CacheConfig is the cache specific configuration
+// With SnapshotFile set, the cache is written to that file on shutdown and
+// restored from it on start.
 type CacheConfig struct {
 	MaxEntries    int    `json:"MaxEntries"`
 	MinTTL        uint32 `json:"MinTTL"`
 	FlushInterval int    `json:"FlushInterval"`
 	Policy        string `json:"Policy"`
+	SnapshotFile  string `json:"SnapshotFile,omitempty"`
 }
 
 // CacheEntry is the entry layout of the cache prefill entries in the config
@@ -46,60 +115,282 @@ type CacheEntry struct {
 	Ttl   int    `json:"Ttl"`
 }
 
+// Backends of the web GUI
+const (
+	WebBackendLocal  = "local"
+	WebBackendRemote = "remote"
+)
+
 // WebConfig is the configuration for the web GUI.
+// ApiToken is the bearer token the web GUI calls the API with, if the API requires one.
+// AssetsDir is a directory of web/static files served instead of the built-in ones,
+// re-read on every request, for developing the web GUI without rebuilding.
+// Backend is where the pages read the cache and the statistics: local, in the
+// daemon process, or remote, through the API at ApiUrl (the API of this daemon by default).
+// With SharePort the web GUI is served under /ui/ on the API address instead of Address.
 type WebConfig struct {
-	Address string `json:"Address"`
+	Address   string    `json:"Address"`
+	ApiToken  string    `json:"ApiToken"`
+	TLS       TLSConfig `json:"TLS"`
+	AssetsDir string    `json:"AssetsDir,omitempty"`
+	Backend   string    `json:"Backend"`
+	ApiUrl    string    `json:"ApiUrl,omitempty"`
+	SharePort bool      `json:"SharePort"`
 }
 
 // ApiConfig is the configuration for the HTTP API.
+// Without Tokens and Users the API is open to everyone who can reach it.
+// CorsOrigins are the origins allowed to call the API from a browser, "*" for any.
 type ApiConfig struct {
-	Address string `json:"Address"`
+	Address     string        `json:"Address"`
+	Tokens      []TokenConfig `json:"Tokens"`
+	Users       []UserConfig  `json:"Users"`
+	CorsOrigins []string      `json:"CorsOrigins"`
+	TLS         TLSConfig     `json:"TLS"`
 }
 
-// Valid checks if the loaded config is valid
-func (c *Config) Valid() bool {
-	if c.Cache.Policy != PolicyDefault && c.Cache.Policy != PolicyKeepMostUsed {
-		return false
-	}
+// TLSConfig is the certificate an HTTP server is served with over TLS.
+// Without CertFile the server is plain HTTP. With ClientCAFile the clients
+// must present a certificate signed by one of its CAs (mutual TLS).
+// The files are re-read when they change.
+type TLSConfig struct {
+	CertFile     string `json:"CertFile"`
+	KeyFile      string `json:"KeyFile"`
+	ClientCAFile string `json:"ClientCAFile"`
+}
+
+// Enabled checks if the server is served over TLS
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != ""
+}
 
-	return true
+// Scopes of the API tokens and users: read can only read,
+// admin can also change the cache and the config
+const (
+	ScopeRead  = "read"
+	ScopeAdmin = "admin"
+)
+
+// TokenConfig is a static bearer token for the API
+type TokenConfig struct {
+	Token string `json:"Token"`
+	Scope string `json:"Scope"`
 }
 
-// Load the contents of the JSON config file and make some validations
+// UserConfig is a user for HTTP basic auth to the API.
+// PasswordHash is a bcrypt hash, e.g. from htpasswd -nB.
+type UserConfig struct {
+	Username     string `json:"Username"`
+	PasswordHash string `json:"PasswordHash"`
+	Scope        string `json:"Scope"`
+}
+
+// StatsConfig is the configuration of the in-memory query statistics.
+// Window and Resolution are in seconds.
+type StatsConfig struct {
+	Window     int `json:"Window"`
+	Resolution int `json:"Resolution"`
+}
+
+// RotationConfig is the rotation policy of a log file.
+// MaxSize is in megabytes and MaxAge in hours; zero disables the limit.
+type RotationConfig struct {
+	MaxSize    int `json:"MaxSize"`
+	MaxAge     int `json:"MaxAge"`
+	MaxBackups int `json:"MaxBackups"`
+}
+
+// LogConfig is the configuration of the daemon's own log
+type LogConfig struct {
+	File     string         `json:"File"`
+	Level    string         `json:"Level"`
+	Format   string         `json:"Format"`
+	Rotation RotationConfig `json:"Rotation"`
+}
+
+// QueryLogConfig is the configuration of the per-query log
+type QueryLogConfig struct {
+	Enabled  bool           `json:"Enabled"`
+	File     string         `json:"File"`
+	Format   string         `json:"Format"`
+	Rotation RotationConfig `json:"Rotation"`
+}
+
+// DnstapConfig is the configuration of the dnstap output.
+// The frames are sent to the Unix socket Socket or, if it is not set, written to File.
+type DnstapConfig struct {
+	Enabled  bool   `json:"Enabled"`
+	Socket   string `json:"Socket"`
+	File     string `json:"File"`
+	Identity string `json:"Identity"`
+}
+
+// PrivilegesConfig is who the daemon runs as once all its listeners are bound.
+// Group defaults to the primary group of User. With Chroot set, the daemon
+// changes its root to that directory and all the paths read afterwards,
+// e.g. on config reload, are resolved in it.
+type PrivilegesConfig struct {
+	User   string `json:"User"`
+	Group  string `json:"Group"`
+	Chroot string `json:"Chroot"`
+}
+
+// Load the config file in the format of its extension, override it with
+// the environment, fill in the defaults and validate it.
+// The values of the file are kept apart for Store.
+// An empty path loads the config from the environment only.
+// A config with invalid fields is reported with a ValidationErrors error.
 func Load(config_path string) (*Config, error) {
-	file, err := os.Open(config_path)
-	if err != nil {
-		log.Printf("error opening config file %s", err)
-		return nil, err
+	config := new(Config)
+
+	var file *Config
+	if config_path != "" {
+		format, err := FormatOf(config_path)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := os.ReadFile(config_path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening config file: %s", err)
+		}
+
+		if err := decode(format, data, config); err != nil {
+			return nil, fmt.Errorf("error decoding %s config %s: %s", format, config_path, err)
+		}
+
+		if file, err = config.clone(); err != nil {
+			return nil, err
+		}
 	}
 
-	decoder := json.NewDecoder(file)
-	config := new(Config)
-	err = decoder.Decode(config)
-	if err != nil {
-		log.Printf("error decoding json config: %s", err)
+	if err := config.ApplyEnv(os.LookupEnv); err != nil {
 		return nil, err
 	}
 
-	if !config.Valid() {
-		log.Printf("invalid config")
-		return nil, fmt.Errorf("invalid config")
+	config.SetDefaults()
+	if errs := config.Validate(); len(errs) > 0 {
+		return nil, errs
+	}
+
+	config.path = config_path
+	if file != nil {
+		loaded, err := config.clone()
+		if err != nil {
+			return nil, err
+		}
+		config.origin = &origin{file: file, loaded: loaded}
 	}
 
 	return config, nil
 }
 
-// Store the config obj in the json file
-func (c *Config) Store() {
-	file, err := os.Open("config.json")
+// Path returns the file the config was loaded from
+func (c *Config) Path() string {
+	return c.path
+}
+
+// SetPath sets the file the config is stored in
+func (c *Config) SetPath(path string) {
+	c.path = path
+}
+
+// Store the config obj in the file it was loaded from, in the same format.
+// Only the fields changed since it was loaded are written over the values of
+// the file, never the environment overrides or the defaults.
+// The file is replaced atomically so a failed write keeps the old config.
+func (c *Config) Store() error {
+	staged, err := c.Stage()
+	if err != nil {
+		return err
+	}
+
+	return staged.Commit()
+}
+
+// Staged is a config written next to its file, ready to replace it
+type Staged struct {
+	config *Config
+	stored *Config
+	temp   string
+}
+
+// Stage writes the config as Store does, but to a temporary file next to its
+// file, so that it can be checked to be storable before it is used.
+// The staged config is then either committed or aborted.
+func (c *Config) Stage() (*Staged, error) {
+	if c.path == "" {
+		return nil, fmt.Errorf("config has no file to store to")
+	}
+
+	if errs := c.Validate(); len(errs) > 0 {
+		return nil, errs
+	}
+
+	format, err := FormatOf(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := c.stored()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := encode(format, stored)
 	if err != nil {
-		log.Printf("error opening config file")
-		return
+		return nil, err
 	}
 
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(&c)
+	file, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
 	if err != nil {
-		log.Printf("config save err: %s", err)
+		return nil, err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return nil, err
 	}
+
+	if info, err := os.Stat(c.path); err == nil {
+		os.Chmod(file.Name(), info.Mode())
+	}
+
+	return &Staged{config: c, stored: stored, temp: file.Name()}, nil
+}
+
+// Commit replaces the file of the config with the staged one
+func (s *Staged) Commit() error {
+	if err := os.Rename(s.temp, s.config.path); err != nil {
+		os.Remove(s.temp)
+		return err
+	}
+
+	// later changes are compared with what is running and stored now
+	if s.config.origin != nil {
+		loaded, err := s.config.clone()
+		if err != nil {
+			return err
+		}
+		s.config.origin = &origin{file: s.stored, loaded: loaded}
+	}
+
+	return nil
+}
+
+// Abort drops the staged config, keeping the file as it is
+func (s *Staged) Abort() {
+	os.Remove(s.temp)
 }
@@ -0,0 +1,289 @@
+package config
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func getValidConfig() *Config {
+	cfg := new(Config)
+	cfg.Server.Address = "127.0.0.1:53"
+	cfg.Server.Servers = []string{"8.8.8.8:53"}
+	cfg.Server.ServersHTTPS = []string{"https://1.1.1.1/dns-query"}
+	cfg.Cache.MaxEntries = 100
+	cfg.Cache.FlushInterval = 30
+	cfg.Cache.Policy = PolicyDefault
+	cfg.Web.Address = "localhost:8080"
+	cfg.Api.Address = "localhost:8282"
+	cfg.Entries = []CacheEntry{
+		{Key: "asdf.bg", Type: "A", Value: net.ParseIP("1.2.3.4")},
+	}
+	cfg.SetDefaults()
+
+	return cfg
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+	cfg, err := Load("config.json")
+	if err != nil {
+		t.Fatalf("the example config should load: %s", err)
+	}
+
+	if cfg.Path() != "config.json" {
+		t.Fatalf("unexpected path %s", cfg.Path())
+	}
+}
+
+func TestValid(t *testing.T) {
+	if !getValidConfig().Valid() {
+		t.Fatal("config should be valid")
+	}
+
+	invalid := []func(*Config){
+		func(c *Config) { c.Server.Address = "127.0.0.1" },
+		func(c *Config) { c.Server.Servers = nil },
+		func(c *Config) { c.Server.ServersHTTPS = []string{"http://1.1.1.1/dns-query"} },
+		func(c *Config) { c.Cache.Policy = "unknown" },
+		func(c *Config) { c.Server.ShutdownTimeout = -1 },
+		func(c *Config) { c.Server.Edns.UDPSize = 65535 },
+		func(c *Config) { c.Server.Edns.ForwardOptions = []int{8, 0} },
+		func(c *Config) { c.Server.Address = "" },
+		func(c *Config) { c.Server.Listeners = []ListenerConfig{{Address: "[::1]:53", Protocol: "quic"}} },
+		func(c *Config) { c.Server.Listeners = []ListenerConfig{{Address: "[::1]:853", Protocol: ListenerDoT}} },
+		func(c *Config) { c.Server.Listeners = []ListenerConfig{{Address: "127.0.0.1:53", Interface: "eth0"}} },
+		func(c *Config) { c.Cache.FlushInterval = 0 },
+		func(c *Config) { c.Entries[0].Type = "MX" },
+		func(c *Config) { c.Entries[0].Value = net.ParseIP("::1") },
+		func(c *Config) { c.Entries[0].Ttl = -1 },
+		func(c *Config) { c.Log.Level = "verbose" },
+		func(c *Config) { c.Privileges.Chroot = "var/empty" },
+		func(c *Config) { c.Privileges.Group = "nogroup" },
+		func(c *Config) { c.Api.TLS = TLSConfig{CertFile: "api.crt"} },
+		func(c *Config) { c.Web.TLS = TLSConfig{ClientCAFile: "ca.crt"} },
+		func(c *Config) { c.Api.Tokens = []TokenConfig{{Token: "secret", Scope: "write"}} },
+		func(c *Config) {
+			c.Api.Users = []UserConfig{{Username: "ops", PasswordHash: "plain", Scope: ScopeRead}}
+		},
+	}
+
+	for i, change := range invalid {
+		cfg := getValidConfig()
+		change(cfg)
+		if cfg.Valid() {
+			t.Errorf("config %d should be invalid", i)
+		}
+	}
+}
+
+func TestValidateFieldPaths(t *testing.T) {
+	cfg := getValidConfig()
+	cfg.Server.Servers = append(cfg.Server.Servers, "8.8.4.4")
+	cfg.Entries = append(cfg.Entries, CacheEntry{Key: "qwer.bg", Type: "MX", Ttl: -5})
+
+	var fields []string
+	for _, err := range cfg.Validate() {
+		fields = append(fields, err.Field)
+	}
+
+	expected := []string{"Server.Servers[1]", "CacheEntries[1].Ttl", "CacheEntries[1].Type"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("expected errors for %v, got %v", expected, fields)
+	}
+}
+
+func TestSetDefaults(t *testing.T) {
+	cfg := new(Config)
+	cfg.Cache.MaxEntries = 5
+	cfg.SetDefaults()
+
+	if cfg.Cache.MaxEntries != 5 {
+		t.Fatal("set values should be kept")
+	}
+
+	if cfg.Cache.FlushInterval != 30 || cfg.Cache.Policy != PolicyDefault || cfg.Stats.Resolution != 60 {
+		t.Fatal("missing values should be defaulted")
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	cfg := getValidConfig()
+
+	if err := cfg.Store(); err == nil {
+		t.Fatal("store without a path should fail")
+	}
+
+	cfg.SetPath(path)
+	if err := cfg.Store(); err != nil {
+		t.Fatalf("store failed: %s", err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("load failed: %s", err)
+	}
+
+	loaded.origin = nil
+	if !reflect.DeepEqual(cfg, loaded) {
+		t.Fatalf("stored and loaded configs differ: %v != %v", cfg, loaded)
+	}
+
+	files, _ := os.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Fatalf("temporary files left behind: %v", files)
+	}
+}
+
+func TestStage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	cfg := getValidConfig()
+	cfg.SetPath(path)
+
+	staged, err := cfg.Stage()
+	if err != nil {
+		t.Fatalf("stage failed: %s", err)
+	}
+	staged.Abort()
+
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 0 {
+		t.Fatalf("an aborted config should leave no files, got %v", files)
+	}
+
+	cfg.SetPath(filepath.Join(path, "missing", "config.json"))
+	if _, err := cfg.Stage(); err == nil {
+		t.Fatal("staging in a missing directory should fail")
+	}
+}
+
+func TestStoreKeepsFileValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	file := `{"Server": {"Address": "127.0.0.1:53", "Servers": ["8.8.8.8:53"]}, "Cache": {"MaxEntries": 5}}`
+	if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DNSCACHED_WEB_APITOKEN", "secret")
+
+	running, err := Load(path)
+	if err != nil {
+		t.Fatalf("load failed: %s", err)
+	}
+
+	// an edit of the running config, e.g. through the API
+	for _, maxEntries := range []int{7, 9} {
+		edited, err := running.clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		edited.Cache.MaxEntries = maxEntries
+		edited.Inherit(running)
+		if err := edited.Store(); err != nil {
+			t.Fatalf("store failed: %s", err)
+		}
+		running = edited
+
+		data, _ := os.ReadFile(path)
+		stored := new(Config)
+		if err := json.Unmarshal(data, stored); err != nil {
+			t.Fatal(err)
+		}
+
+		if stored.Cache.MaxEntries != maxEntries {
+			t.Errorf("expected the edited value %d, got %d", maxEntries, stored.Cache.MaxEntries)
+		}
+		if stored.Web.ApiToken != "" {
+			t.Errorf("the token of the environment was stored")
+		}
+		if stored.Stats.Resolution != 0 || stored.Server.Address != "127.0.0.1:53" {
+			t.Errorf("expected only the values of the file, got %s", data)
+		}
+	}
+}
+
+func TestStoreFormats(t *testing.T) {
+	for _, name := range []string{"config.yaml", "config.yml", "config.toml"} {
+		path := filepath.Join(t.TempDir(), name)
+		cfg := getValidConfig()
+		cfg.SetPath(path)
+
+		if err := cfg.Store(); err != nil {
+			t.Fatalf("store %s failed: %s", name, err)
+		}
+
+		loaded, err := Load(path)
+		if err != nil {
+			t.Fatalf("load %s failed: %s", name, err)
+		}
+
+		loaded.origin = nil
+		if !reflect.DeepEqual(cfg, loaded) {
+			t.Fatalf("stored and loaded %s configs differ: %v != %v", name, cfg, loaded)
+		}
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := Load("config.ini"); err == nil {
+		t.Fatal("load should fail for unknown extensions")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"DNSCACHED_SERVER_ADDRESS":      "[::1]:5353",
+		"DNSCACHED_SERVER_SERVERS":      "1.1.1.1:53, 9.9.9.9:53",
+		"DNSCACHED_CACHE_MINTTL":        "120",
+		"DNSCACHED_QUERYLOG_ENABLED":    "true",
+		"DNSCACHED_LOG_ROTATION_MAXAGE": "12",
+		"DNSCACHED_CACHEENTRIES":        `[{"Key": "env.bg", "Type": "A", "Value": "4.3.2.1"}]`,
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	cfg := getValidConfig()
+	if err := cfg.ApplyEnv(lookup); err != nil {
+		t.Fatalf("apply env failed: %s", err)
+	}
+
+	if cfg.Server.Address != "[::1]:5353" || cfg.Cache.MinTTL != 120 || !cfg.QueryLog.Enabled || cfg.Log.Rotation.MaxAge != 12 {
+		t.Fatalf("scalar fields not overridden: %v", cfg)
+	}
+
+	if !reflect.DeepEqual(cfg.Server.Servers, []string{"1.1.1.1:53", "9.9.9.9:53"}) {
+		t.Fatalf("unexpected servers %v", cfg.Server.Servers)
+	}
+
+	if len(cfg.Entries) != 1 || cfg.Entries[0].Key != "env.bg" || !cfg.Entries[0].Value.Equal(net.ParseIP("4.3.2.1")) {
+		t.Fatalf("unexpected entries %v", cfg.Entries)
+	}
+
+	env = map[string]string{"DNSCACHED_CACHE_MAXENTRIES": "many"}
+	err := cfg.ApplyEnv(lookup)
+	if errs, ok := err.(ValidationErrors); !ok || errs[0].Field != "DNSCACHED_CACHE_MAXENTRIES" {
+		t.Fatalf("expected an error for the bad variable, got %v", err)
+	}
+}
+
+func TestAllListeners(t *testing.T) {
+	cfg := getValidConfig()
+	cfg.Server.Listeners = []ListenerConfig{{Address: "[::1]:443", Protocol: ListenerDoH}}
+	cfg.SetDefaults()
+
+	expected := []ListenerConfig{
+		{Address: cfg.Server.Address, Protocol: ListenerUDP},
+		{Address: "[::1]:443", Protocol: ListenerDoH, Path: "/dns-query"},
+	}
+	if !reflect.DeepEqual(cfg.Server.AllListeners(), expected) {
+		t.Fatalf("expected listeners %v, got %v", expected, cfg.Server.AllListeners())
+	}
+
+	cfg.Server.Address = ""
+	if len(cfg.Server.AllListeners()) != 1 {
+		t.Fatal("only the configured listeners should be used without an address")
+	}
+}
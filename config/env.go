@@ -0,0 +1,104 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding the config.
+// The variable of a field is its JSON path in upper case joined with
+// underscores, e.g. DNSCACHED_SERVER_ADDRESS or DNSCACHED_CACHE_MAXENTRIES.
+const EnvPrefix = "DNSCACHED"
+
+// Set a field from the string value of its environment variable.
+// Lists of strings are comma-separated; other composite values are JSON.
+func setFromEnv(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Uint32:
+		u, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return err
+		}
+		field.SetUint(u)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String {
+			var values []string
+			for _, v := range strings.Split(value, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+			field.Set(reflect.ValueOf(values))
+			return nil
+		}
+		fallthrough
+	default:
+		return json.Unmarshal([]byte(value), field.Addr().Interface())
+	}
+
+	return nil
+}
+
+// Walk the struct fields and override the ones set in the environment
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) ValidationErrors {
+	var errs ValidationErrors
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		envName := prefix + "_" + strings.ToUpper(name)
+
+		if field.Type.Kind() == reflect.Struct {
+			errs = append(errs, applyEnv(v.Field(i), envName, lookup)...)
+			continue
+		}
+
+		value, ok := lookup(envName)
+		if !ok {
+			continue
+		}
+
+		if err := setFromEnv(v.Field(i), value); err != nil {
+			errs = append(errs, FieldError{
+				Field:   envName,
+				Message: fmt.Sprintf("bad value %q: %s", value, err),
+			})
+		}
+	}
+
+	return errs
+}
+
+// ApplyEnv overrides the config fields set in DNSCACHED_* environment variables
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	if errs := applyEnv(reflect.ValueOf(c).Elem(), EnvPrefix, lookup); len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of the config file, chosen by the file extension
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// FormatOf returns the config format of a file by its extension
+func FormatOf(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON, nil
+	case ".yaml", ".yml":
+		return FormatYAML, nil
+	case ".toml":
+		return FormatTOML, nil
+	}
+
+	return "", fmt.Errorf("unknown config format of %s, expecting .json, .yaml, .yml or .toml", path)
+}
+
+// decode the config from data in the given format.
+// YAML and TOML are converted to JSON first so that all the formats
+// share the field names and value parsing of the JSON config.
+func decode(format string, data []byte, c *Config) error {
+	switch format {
+	case FormatYAML:
+		var raw interface{}
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+		if raw == nil {
+			return nil
+		}
+
+		converted, err := json.Marshal(raw)
+		if err != nil {
+			return err
+		}
+		data = converted
+	case FormatTOML:
+		var raw map[string]interface{}
+		if err := toml.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+
+		converted, err := json.Marshal(raw)
+		if err != nil {
+			return err
+		}
+		data = converted
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(c)
+}
+
+// encode the config in the given format
+func encode(format string, c *Config) ([]byte, error) {
+	data, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+
+	if format == FormatJSON {
+		return append(data, '\n'), nil
+	}
+
+	var raw map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	normalizeNumbers(raw)
+
+	if format == FormatYAML {
+		return yaml.Marshal(raw)
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(raw); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Replace the JSON numbers in a decoded value with integers where possible
+// so that they are not written as floats in the other formats
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeNumbers(item)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// origin is what a loaded config came from, so that storing it writes back
+// the values of the file rather than the environment overrides and the
+// defaults, which may hold secrets that were never meant for the file
+type origin struct {
+	// the values of the file alone
+	file *Config
+	// the config as loaded, with the overrides and the defaults
+	loaded *Config
+}
+
+// Get a deep copy of the config
+func (c *Config) clone() (*Config, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := new(Config)
+	if err := json.Unmarshal(data, copied); err != nil {
+		return nil, err
+	}
+	copied.path = c.path
+
+	return copied, nil
+}
+
+// Inherit takes the file of the config that c replaces and what that file
+// held, so that Store writes only the fields changed since it was loaded
+func (c *Config) Inherit(previous *Config) {
+	c.path = previous.path
+	c.origin = previous.origin
+}
+
+// Get the config to write to the file: the values of the file, with the
+// fields that differ from the config as loaded
+func (c *Config) stored() (*Config, error) {
+	if c.origin == nil {
+		return c, nil
+	}
+
+	stored, err := c.origin.file.clone()
+	if err != nil {
+		return nil, err
+	}
+
+	mergeChanged(reflect.ValueOf(stored).Elem(), reflect.ValueOf(c).Elem(), reflect.ValueOf(c.origin.loaded).Elem())
+	return stored, nil
+}
+
+// Set the fields of dst to the ones of changed that differ from loaded.
+// Structs are compared field by field, lists as a whole.
+func mergeChanged(dst reflect.Value, changed reflect.Value, loaded reflect.Value) {
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+
+		if t.Field(i).Type.Kind() == reflect.Struct {
+			mergeChanged(dst.Field(i), changed.Field(i), loaded.Field(i))
+			continue
+		}
+
+		if !reflect.DeepEqual(changed.Field(i).Interface(), loaded.Field(i).Interface()) {
+			dst.Field(i).Set(changed.Field(i))
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// FieldError is a problem with a single field of the config.
+// Field is the path of the field in the JSON config, e.g. "Server.Servers[0]".
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationErrors is the list of all the problems found in a config
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+
+	return "invalid config: " + strings.Join(messages, "; ")
+}
+
+// SetDefaults fills in the values missing from the config
+func (c *Config) SetDefaults() {
+	if c.Server.ShutdownTimeout == 0 {
+		c.Server.ShutdownTimeout = 10
+	}
+
+	if c.Server.Edns.UDPSize == 0 {
+		// the DNS flag day 2020 default, avoiding IP fragmentation
+		c.Server.Edns.UDPSize = 1232
+	}
+
+	for i := range c.Server.Listeners {
+		listener := &c.Server.Listeners[i]
+		if listener.Protocol == "" {
+			listener.Protocol = ListenerUDP
+		}
+
+		if listener.Protocol == ListenerDoH && listener.Path == "" {
+			listener.Path = "/dns-query"
+		}
+	}
+
+	if c.Cache.MaxEntries == 0 {
+		c.Cache.MaxEntries = 1000
+	}
+
+	if c.Cache.FlushInterval == 0 {
+		c.Cache.FlushInterval = 30
+	}
+
+	if c.Cache.Policy == "" {
+		c.Cache.Policy = PolicyDefault
+	}
+
+	if c.Web.Address == "" {
+		c.Web.Address = "localhost:8080"
+	}
+
+	if c.Web.Backend == "" {
+		c.Web.Backend = WebBackendLocal
+	}
+
+	if c.Api.Address == "" {
+		c.Api.Address = "localhost:8282"
+	}
+
+	if c.Api.CorsOrigins == nil {
+		c.Api.CorsOrigins = []string{"*"}
+	}
+
+	if c.Stats.Window == 0 {
+		c.Stats.Window = 3600
+	}
+
+	if c.Stats.Resolution == 0 {
+		c.Stats.Resolution = 60
+	}
+
+	if c.Log.Level == "" {
+		c.Log.Level = LogLevelInfo
+	}
+
+	if c.Log.Format == "" {
+		c.Log.Format = LogFormatText
+	}
+
+	if c.QueryLog.Format == "" {
+		c.QueryLog.Format = LogFormatJSON
+	}
+}
+
+// validator collects the field errors of a config
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) add(field string, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check that an address is in the host:port form
+func (v *validator) address(field string, address string) {
+	if address == "" {
+		v.add(field, "address is required")
+		return
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		v.add(field, "%q is not a host:port address", address)
+	}
+}
+
+func (v *validator) oneOf(field string, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+
+	v.add(field, "%q is not one of %s", value, strings.Join(allowed, ", "))
+}
+
+func (v *validator) notNegative(field string, value int) {
+	if value < 0 {
+		v.add(field, "must not be negative, got %d", value)
+	}
+}
+
+func (v *validator) positive(field string, value int) {
+	if value <= 0 {
+		v.add(field, "must be positive, got %d", value)
+	}
+}
+
+func (v *validator) listener(field string, l ListenerConfig) {
+	v.address(field+".Address", l.Address)
+	if l.Interface != "" {
+		if host, _, err := net.SplitHostPort(l.Address); err == nil && host != "" {
+			v.add(field+".Address", "only the port can be set when listening on an interface, got %q", l.Address)
+		}
+	}
+
+	v.oneOf(field+".Protocol", l.Protocol, ListenerUDP, ListenerTCP, ListenerDoT, ListenerDoH)
+
+	if l.Protocol == ListenerDoT || l.Protocol == ListenerDoH {
+		if l.CertFile == "" {
+			v.add(field+".CertFile", "certificate is required by %s", l.Protocol)
+		}
+		if l.KeyFile == "" {
+			v.add(field+".KeyFile", "key is required by %s", l.Protocol)
+		}
+	}
+
+	if l.Protocol == ListenerDoH && !strings.HasPrefix(l.Path, "/") {
+		v.add(field+".Path", "%q is not an absolute url path", l.Path)
+	}
+}
+
+func (v *validator) tls(field string, t TLSConfig) {
+	if t.Enabled() && t.KeyFile == "" {
+		v.add(field+".KeyFile", "key is required with a certificate")
+	}
+
+	if !t.Enabled() && (t.KeyFile != "" || t.ClientCAFile != "") {
+		v.add(field+".CertFile", "certificate is required with a key or client CA")
+	}
+}
+
+func (v *validator) rotation(field string, r RotationConfig) {
+	v.notNegative(field+".MaxSize", r.MaxSize)
+	v.notNegative(field+".MaxAge", r.MaxAge)
+	v.notNegative(field+".MaxBackups", r.MaxBackups)
+}
+
+// Validate returns all the problems found in the config.
+// It expects the defaults to be already set.
+func (c *Config) Validate() ValidationErrors {
+	v := new(validator)
+
+	if c.Server.Address != "" {
+		v.address("Server.Address", c.Server.Address)
+	} else if len(c.Server.Listeners) == 0 {
+		v.add("Server.Address", "an address or at least one listener is required")
+	}
+
+	for i, listener := range c.Server.Listeners {
+		v.listener(fmt.Sprintf("Server.Listeners[%d]", i), listener)
+	}
+
+	if len(c.Server.Servers) == 0 {
+		v.add("Server.Servers", "at least one DNS server is required")
+	}
+
+	for i, server := range c.Server.Servers {
+		v.address(fmt.Sprintf("Server.Servers[%d]", i), server)
+	}
+
+	for i, server := range c.Server.ServersHTTPS {
+		u, err := url.Parse(server)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			v.add(fmt.Sprintf("Server.ServersHTTPS[%d]", i), "%q is not an https:// URL", server)
+		}
+	}
+
+	v.positive("Server.ShutdownTimeout", c.Server.ShutdownTimeout)
+
+	if c.Server.Edns.UDPSize < 512 || c.Server.Edns.UDPSize > 4096 {
+		v.add("Server.Edns.UDPSize", "%d is not between 512 and 4096", c.Server.Edns.UDPSize)
+	}
+
+	for i, code := range c.Server.Edns.ForwardOptions {
+		if code <= 0 || code > 65535 {
+			v.add(fmt.Sprintf("Server.Edns.ForwardOptions[%d]", i), "%d is not an EDNS0 option code", code)
+		}
+	}
+
+	v.positive("Cache.MaxEntries", c.Cache.MaxEntries)
+	v.positive("Cache.FlushInterval", c.Cache.FlushInterval)
+	v.oneOf("Cache.Policy", c.Cache.Policy, PolicyDefault, PolicyKeepMostUsed)
+
+	for i, entry := range c.Entries {
+		field := fmt.Sprintf("CacheEntries[%d]", i)
+
+		if entry.Key == "" {
+			v.add(field+".Key", "key is required")
+		}
+
+		v.notNegative(field+".Ttl", entry.Ttl)
+
+		switch entry.Type {
+		case "A":
+			if entry.Value.To4() == nil {
+				v.add(field+".Value", "type A needs an IPv4 address, got %q", entry.Value.String())
+			}
+		case "AAAA":
+			if entry.Value == nil || entry.Value.To4() != nil {
+				v.add(field+".Value", "type AAAA needs an IPv6 address, got %q", entry.Value.String())
+			}
+		default:
+			v.add(field+".Type", "%q is not one of A, AAAA", entry.Type)
+		}
+	}
+
+	v.address("Web.Address", c.Web.Address)
+	v.tls("Web.TLS", c.Web.TLS)
+	v.oneOf("Web.Backend", c.Web.Backend, WebBackendLocal, WebBackendRemote)
+	if c.Web.ApiUrl != "" && !strings.HasPrefix(c.Web.ApiUrl, "http://") && !strings.HasPrefix(c.Web.ApiUrl, "https://") {
+		v.add("Web.ApiUrl", "%q is not an http:// or https:// URL", c.Web.ApiUrl)
+	}
+	v.address("Api.Address", c.Api.Address)
+	v.tls("Api.TLS", c.Api.TLS)
+
+	for i, token := range c.Api.Tokens {
+		field := fmt.Sprintf("Api.Tokens[%d]", i)
+		if token.Token == "" {
+			v.add(field+".Token", "token is required")
+		}
+		v.oneOf(field+".Scope", token.Scope, ScopeRead, ScopeAdmin)
+	}
+
+	for i, user := range c.Api.Users {
+		field := fmt.Sprintf("Api.Users[%d]", i)
+		if user.Username == "" {
+			v.add(field+".Username", "username is required")
+		}
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			v.add(field+".PasswordHash", "not a bcrypt hash: %s", err)
+		}
+		v.oneOf(field+".Scope", user.Scope, ScopeRead, ScopeAdmin)
+	}
+
+	v.positive("Stats.Window", c.Stats.Window)
+	v.positive("Stats.Resolution", c.Stats.Resolution)
+
+	v.oneOf("Log.Level", c.Log.Level, LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError)
+	v.oneOf("Log.Format", c.Log.Format, LogFormatText, LogFormatJSON)
+	v.rotation("Log.Rotation", c.Log.Rotation)
+
+	v.oneOf("QueryLog.Format", c.QueryLog.Format, LogFormatJSON)
+	v.rotation("QueryLog.Rotation", c.QueryLog.Rotation)
+	if c.QueryLog.Enabled && c.QueryLog.File == "" {
+		v.add("QueryLog.File", "file is required when the query log is enabled")
+	}
+
+	if c.Dnstap.Enabled && c.Dnstap.Socket == "" && c.Dnstap.File == "" {
+		v.add("Dnstap.Socket", "socket or file is required when dnstap is enabled")
+	}
+
+	if c.Privileges.Group != "" && c.Privileges.User == "" {
+		v.add("Privileges.Group", "a group needs a user to switch to")
+	}
+
+	if c.Privileges.Chroot != "" && !filepath.IsAbs(c.Privileges.Chroot) {
+		v.add("Privileges.Chroot", "%q is not an absolute path", c.Privileges.Chroot)
+	}
+
+	return v.errs
+}
+
+// Valid checks if the loaded config is valid
+func (c *Config) Valid() bool {
+	return len(c.Validate()) == 0
+}
@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/config"
+)
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// ParseLevel converts a config log level to a slog level
+func ParseLevel(level string) (slog.Level, error) {
+	switch level {
+	case config.LogLevelDebug:
+		return slog.LevelDebug, nil
+	case "", config.LogLevelInfo:
+		return slog.LevelInfo, nil
+	case config.LogLevelWarn:
+		return slog.LevelWarn, nil
+	case config.LogLevelError:
+		return slog.LevelError, nil
+	}
+
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q", level)
+}
+
+// OpenFile opens a log file with the given rotation policy
+func OpenFile(path string, rotation config.RotationConfig) (*RotatingFile, error) {
+	return NewRotatingFile(path,
+		int64(rotation.MaxSize)*1024*1024,
+		time.Duration(rotation.MaxAge)*time.Hour,
+		rotation.MaxBackups)
+}
+
+// teeWriter writes to stdout and to the log file. Unlike io.MultiWriter,
+// it keeps writing to stdout when the file fails.
+type teeWriter struct {
+	out  io.Writer
+	file io.Writer
+}
+
+func (t teeWriter) Write(p []byte) (int, error) {
+	t.file.Write(p)
+	return t.out.Write(p)
+}
+
+// Setup configures the default logger from the log config.
+// Messages are written to stdout and, if set, to the configured file.
+// The returned closer closes the log file.
+func Setup(cfg config.LogConfig) (io.Closer, error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	var out io.Writer = os.Stdout
+	var file io.Closer = nopCloser{}
+	if cfg.File != "" {
+		rotating, err := OpenFile(cfg.File, cfg.Rotation)
+		if err != nil {
+			return nil, err
+		}
+		out = teeWriter{out: os.Stdout, file: rotating}
+		file = rotating
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if cfg.Format == config.LogFormatJSON {
+		handler = slog.NewJSONHandler(out, options)
+	} else {
+		handler = slog.NewTextHandler(out, options)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return file, nil
+}
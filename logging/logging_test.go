@@ -0,0 +1,196 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func countBackups(t *testing.T, path string) int {
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(backups)
+}
+
+func TestRotateOnSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.txt")
+	file, err := NewRotatingFile(path, 10, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	file.Write([]byte("0123456789"))
+	if countBackups(t, path) != 0 {
+		t.Fatal("should not rotate before reaching the size")
+	}
+
+	file.Write([]byte("x"))
+	if countBackups(t, path) != 1 {
+		t.Fatal("should rotate after reaching the size")
+	}
+
+	contents, _ := os.ReadFile(path)
+	if string(contents) != "x" {
+		t.Fatalf("unexpected contents %q", contents)
+	}
+}
+
+func TestRotateOnAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.txt")
+	file, err := NewRotatingFile(path, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	now := time.Now()
+	file.now = func() time.Time { return now }
+	file.Write([]byte("first\n"))
+
+	now = now.Add(2 * time.Hour)
+	file.Write([]byte("second\n"))
+
+	if countBackups(t, path) != 1 {
+		t.Fatal("should rotate after reaching the age")
+	}
+}
+
+func TestRemoveOldBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.txt")
+	file, err := NewRotatingFile(path, 1, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	now := time.Now()
+	file.now = func() time.Time { return now }
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		file.Write([]byte("x"))
+	}
+
+	if countBackups(t, path) != 2 {
+		t.Fatalf("expected 2 backups, got %d", countBackups(t, path))
+	}
+}
+
+func TestRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.txt")
+	file, err := NewRotatingFile(path, 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	now := time.Now()
+	file.now = func() time.Time { return now }
+	file.Write([]byte("a"))
+
+	// the backup name is taken by a directory, so the rename fails
+	now = now.Add(time.Second)
+	if err := os.Mkdir(path+"."+now.Format(backupTimeFormat), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("b")); err != nil {
+		t.Fatalf("the write should not fail with the rotation: %s", err)
+	}
+
+	// the rotation is retried only after a while
+	now = now.Add(time.Second)
+	file.Write([]byte("c"))
+	if contents, _ := os.ReadFile(path); string(contents) != "abc" {
+		t.Fatalf("expected all the writes in the current file, got %q", contents)
+	}
+
+	now = now.Add(rotationRetry)
+	file.Write([]byte("d"))
+	if contents, _ := os.ReadFile(path); string(contents) != "d" {
+		t.Fatalf("expected a rotation after the retry delay, got %q", contents)
+	}
+}
+
+func TestReopenFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.txt")
+	file, err := NewRotatingFile(path, 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	now := time.Now()
+	file.now = func() time.Time { return now }
+	file.Write([]byte("a"))
+
+	// the file is renamed, but the new one can't be opened
+	file.openFile = func(string, int, os.FileMode) (*os.File, error) {
+		return nil, os.ErrPermission
+	}
+	now = now.Add(time.Second)
+	file.Write([]byte("b"))
+	if contents, _ := os.ReadFile(path); string(contents) != "ab" || countBackups(t, path) != 0 {
+		t.Fatalf("expected the backup renamed back and written, got %q", contents)
+	}
+
+	file.openFile = os.OpenFile
+	now = now.Add(rotationRetry)
+	file.Write([]byte("c"))
+	if contents, _ := os.ReadFile(path); string(contents) != "c" || countBackups(t, path) != 1 {
+		t.Fatalf("expected a rotation after the retry delay, got %q", contents)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, os.ErrClosed
+}
+
+func TestTeeWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := teeWriter{out: &out, file: failingWriter{}}
+	if _, err := w.Write([]byte("line\n")); err != nil || out.String() != "line\n" {
+		t.Fatalf("a failing file should not stop stdout, got %q, %v", out.String(), err)
+	}
+}
+
+func TestQueryLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	file, err := NewRotatingFile(path, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := newQueryLogger(file)
+	logger.Log(QueryEntry{Name: "google.bg.", Type: "A", Cache: CacheHit})
+	logger.Log(QueryEntry{Name: "dir.bg.", Type: "MX", Cache: CachePassThrough, Upstream: "8.8.8.8:53"})
+	logger.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []QueryEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry QueryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid json line %q: %s", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 2 || entries[1].Upstream != "8.8.8.8:53" || entries[0].Cache != CacheHit {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/config"
+)
+
+// Cache statuses of a logged query
+const (
+	CacheHit         = "hit"
+	CacheMiss        = "miss"
+	CachePassThrough = "passthrough"
+)
+
+// QueryEntry is a single record of the query log
+type QueryEntry struct {
+	Time          time.Time
+	Client        string
+	Name          string
+	Type          string
+	Rcode         string
+	Cache         string
+	Upstream      string `json:",omitempty"`
+	LatencyMillis float64
+}
+
+// QueryLogger writes a JSON line for every handled client query
+type QueryLogger struct {
+	lock    sync.Mutex
+	out     io.WriteCloser
+	encoder *json.Encoder
+}
+
+// NewQueryLogger opens the query log file from the config
+func NewQueryLogger(cfg config.QueryLogConfig) (*QueryLogger, error) {
+	file, err := OpenFile(cfg.File, cfg.Rotation)
+	if err != nil {
+		return nil, err
+	}
+
+	return newQueryLogger(file), nil
+}
+
+func newQueryLogger(out io.WriteCloser) *QueryLogger {
+	return &QueryLogger{out: out, encoder: json.NewEncoder(out)}
+}
+
+// Log writes the entry to the query log
+func (l *QueryLogger) Log(entry QueryEntry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.encoder.Encode(entry)
+}
+
+// Close the query log file
+func (l *QueryLogger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.out.Close()
+}
@@ -0,0 +1,192 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the suffix format of the rotated files
+const backupTimeFormat = "20060102T150405.000"
+
+// rotationRetry is how long a failed rotation waits before it is retried
+const rotationRetry = time.Minute
+
+// RotatingFile is an io.WriteCloser that appends to a file and rotates it
+// when it grows over maxSize bytes or gets older than maxAge.
+// Only the newest maxBackups rotated files are kept.
+type RotatingFile struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	opened     time.Time
+	// the time of the last failed rotation
+	failed time.Time
+	// the backup the open file was renamed to, if the new file couldn't be opened
+	renamed  string
+	now      func() time.Time
+	openFile func(name string, flag int, perm os.FileMode) (*os.File, error)
+}
+
+// NewRotatingFile opens (or creates) the file at path for appending.
+// A zero maxSize, maxAge or maxBackups disables the corresponding limit.
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		now:        time.Now,
+		openFile:   os.OpenFile,
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Open the log file, keeping its current size and age
+func (r *RotatingFile) open() error {
+	file, err := r.openFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = info.Size()
+	r.opened = info.ModTime()
+	if r.size == 0 {
+		r.opened = r.now()
+	}
+
+	return nil
+}
+
+// Write appends p to the file, rotating it first if needed
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	// keep appending to the current file if the rotation fails
+	if r.shouldRotate(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			r.failed = r.now()
+			fmt.Fprintf(os.Stderr, "log file rotation failed: %s\n", err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) shouldRotate(next int64) bool {
+	if r.size == 0 {
+		return false
+	}
+
+	if !r.failed.IsZero() && r.now().Sub(r.failed) < rotationRetry {
+		return false
+	}
+
+	if r.maxSize > 0 && r.size+next > r.maxSize {
+		return true
+	}
+
+	if r.maxAge > 0 && r.now().Sub(r.opened) >= r.maxAge {
+		return true
+	}
+
+	return false
+}
+
+// Rename the current file with a timestamp suffix and start a new one.
+// The current file is closed only once the new one is open, so a failed
+// rotation leaves the file being written. If the new file can't be opened,
+// the backup is renamed back, or else the next rotation only opens the file.
+func (r *RotatingFile) rotate() error {
+	if r.renamed == "" {
+		backup := fmt.Sprintf("%s.%s", r.path, r.now().Format(backupTimeFormat))
+		if err := os.Rename(r.path, backup); err != nil {
+			return err
+		}
+		r.renamed = backup
+	}
+
+	old := r.file
+	if err := r.open(); err != nil {
+		if os.Rename(r.renamed, r.path) == nil {
+			r.renamed = ""
+		}
+		return err
+	}
+	old.Close()
+
+	r.renamed = ""
+	r.failed = time.Time{}
+	r.removeOldBackups()
+	return nil
+}
+
+// Delete the oldest rotated files over maxBackups
+func (r *RotatingFile) removeOldBackups() {
+	if r.maxBackups <= 0 {
+		return
+	}
+
+	backups, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+
+	var rotated []string
+	for _, backup := range backups {
+		suffix := strings.TrimPrefix(backup, r.path+".")
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			rotated = append(rotated, backup)
+		}
+	}
+
+	if len(rotated) <= r.maxBackups {
+		return
+	}
+
+	sort.Strings(rotated)
+	for _, backup := range rotated[:len(rotated)-r.maxBackups] {
+		os.Remove(backup)
+	}
+}
+
+// Close the underlying file
+func (r *RotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
@@ -2,71 +2,54 @@ package main
 
 import (
 	"fmt"
-	"io"
-	"log"
-	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
-
-	"github.com/dvlahovski/go-dnscached/api"
-	"github.com/dvlahovski/go-dnscached/cache"
-	"github.com/dvlahovski/go-dnscached/config"
-	"github.com/dvlahovski/go-dnscached/server"
-	"github.com/dvlahovski/go-dnscached/web"
-	"github.com/miekg/dns"
+	"strings"
 )
 
-func main() {
-	file, err := os.OpenFile("log.txt", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalln("Failed to open log file")
-	}
-	defer file.Close()
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
 
-	multi := io.MultiWriter(file, os.Stdout)
+const usage = `usage: go-dnscached <command> [flags] [args]
 
-	log.SetOutput(multi)
-	log.SetPrefix("go-dnscached: ")
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+commands:
+  serve          run the DNS server, the REST API and the web GUI
+  check-config   validate the config file
+  version        print the version
+  cache          list, get, delete, insert or flush cache entries of the running daemon
+  stats          show the query statistics of the running daemon
+  upstreams      show the upstream servers of the running daemon
+  web            serve only the web GUI, for the REST API of a remote daemon
 
-	log.Printf("Daemon started")
-	defer log.Printf("Daemon shutdown")
-
-	config, err := config.Load("config/config.json")
-	if err != nil {
-		return
-	}
-	fmt.Printf("config loaded: %v\n", config)
+Run "go-dnscached <command> -h" for the flags of a command.
+Without a command the daemon is served in the foreground.
+`
 
-	cache := cache.NewCache(*config)
-	dnsClient := new(dns.Client)
-	httpClient := &http.Client{Timeout: 15 * time.Second}
-	server, err := server.NewServer(cache, config, dnsClient, httpClient)
-	if err != nil {
-		log.Printf("server creation error: %s", err.Error())
-		return
+func main() {
+	// keep the old flag-only invocation working
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") && os.Args[1] != "-h" && os.Args[1] != "-help" {
+		os.Exit(serve(os.Args[1:]))
 	}
 
-	go func() {
-		log.Fatal(server.ListenAndServe())
-	}()
-
-	go func() {
-		log.Fatal(api.Run(server, cache, &config.Api))
-	}()
-
-	go func() {
-		log.Fatal(web.Run(&config.Web, &config.Api))
-	}()
-
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
-
-	sig := <-sigs
-	log.Printf("Caught signal: %s", sig)
-	if err := server.Shutdown(); err != nil {
-		log.Printf("Server shutdown error: %s", err.Error())
+	command, args := os.Args[1], os.Args[2:]
+	switch command {
+	case "serve":
+		os.Exit(serve(args))
+	case "check-config":
+		os.Exit(checkConfig(args))
+	case "version":
+		fmt.Println(version)
+	case "cache":
+		os.Exit(cacheCommand(args))
+	case "stats":
+		os.Exit(statsCommand(args))
+	case "upstreams":
+		os.Exit(upstreamsCommand(args))
+	case "web":
+		os.Exit(webCommand(args))
+	case "help", "-h", "-help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
 	}
 }
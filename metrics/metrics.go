@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "dnscached"
+
+var (
+	// Queries counts the answered client queries by query type and response code
+	Queries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_total",
+		Help:      "Number of client queries by query type and response code.",
+	}, []string{"qtype", "rcode"})
+
+	// InFlight is the number of client queries currently being handled
+	InFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queries_in_flight",
+		Help:      "Number of client queries currently being handled.",
+	})
+
+	// PassThrough counts the queries forwarded without caching by query type
+	PassThrough = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "passthrough_queries_total",
+		Help:      "Number of client queries forwarded without caching by query type.",
+	}, []string{"qtype"})
+
+	// CacheHits counts the successful cache lookups
+	CacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "hits_total",
+		Help:      "Number of cache lookups that found an entry.",
+	})
+
+	// CacheMisses counts the unsuccessful cache lookups
+	CacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "misses_total",
+		Help:      "Number of cache lookups that found nothing.",
+	})
+
+	// CacheInserts counts the entries added to the cache
+	CacheInserts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "inserts_total",
+		Help:      "Number of entries inserted in the cache.",
+	})
+
+	// CacheEvictions counts the entries removed before their ttl expired by reason
+	CacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "evictions_total",
+		Help:      "Number of entries removed from the cache before expiring by reason.",
+	}, []string{"reason"})
+
+	// CacheExpirations counts the entries flushed because their ttl expired
+	CacheExpirations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "expirations_total",
+		Help:      "Number of entries flushed from the cache after expiring.",
+	})
+
+	// CacheSize is the current number of entries in the cache
+	CacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "entries",
+		Help:      "Number of entries currently in the cache.",
+	})
+
+	// UpstreamLatency observes the duration of the requests to each upstream
+	UpstreamLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the requests to the upstream servers.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"upstream"})
+
+	// UpstreamErrors counts the failed requests to each upstream
+	UpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "errors_total",
+		Help:      "Number of failed requests to the upstream servers.",
+	}, []string{"upstream"})
+)
+
+// The reasons of the cache evictions
+const (
+	// an entry deleted through the API
+	EvictionDelete = "delete"
+	// an entry deleted by a bulk flush
+	EvictionPurge = "purge"
+)
+
+// the query types with a label value of their own
+var knownQtypes = map[string]bool{
+	"A": true, "AAAA": true, "CNAME": true, "MX": true, "NS": true, "PTR": true,
+	"SOA": true, "SRV": true, "TXT": true, "CAA": true, "DS": true, "DNSKEY": true,
+	"HTTPS": true, "SVCB": true, "NAPTR": true, "ANY": true, "NONE": true,
+}
+
+// QtypeLabel returns the qtype label value of a query type, "other" for the
+// rare and unknown ones, so that clients can't create unbounded label values
+func QtypeLabel(qtype string) string {
+	if knownQtypes[qtype] {
+		return qtype
+	}
+
+	return "other"
+}
+
+// Handler returns the HTTP handler exposing the metrics in the Prometheus format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
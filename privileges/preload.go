@@ -0,0 +1,80 @@
+package privileges
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// the resolver config of the system
+const resolvConf = "/etc/resolv.conf"
+
+// Preloaded is the system state the upstream HTTP client needs that is out
+// of reach once the root directory is changed: the trusted CAs and the name servers
+type Preloaded struct {
+	RootCAs     *x509.CertPool
+	Nameservers []string
+}
+
+// Preload reads the trusted CAs and the name servers of the system.
+// It is meant to be called before Drop changes the root directory.
+func Preload() (*Preloaded, error) {
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Preloaded{RootCAs: rootCAs, Nameservers: readNameservers(resolvConf)}, nil
+}
+
+// Get the "host:port" addresses of the name servers in a resolv.conf file
+func readNameservers(path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var nameservers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			nameservers = append(nameservers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+
+	return nameservers
+}
+
+// Transport returns an HTTP transport trusting the preloaded CAs and
+// resolving the host names with the preloaded name servers
+func (p *Preloaded) Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: p.RootCAs}
+
+	if len(p.Nameservers) > 0 {
+		dialer := &net.Dialer{Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				var d net.Dialer
+				var err error
+				for _, nameserver := range p.Nameservers {
+					var conn net.Conn
+					if conn, err = d.DialContext(ctx, network, nameserver); err == nil {
+						return conn, nil
+					}
+				}
+				return nil, err
+			},
+		}}
+		transport.DialContext = dialer.DialContext
+	}
+
+	return transport
+}
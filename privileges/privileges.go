@@ -0,0 +1,85 @@
+// Package privileges drops the root privileges of the daemon once its
+// listeners are bound, switching to another user and group and optionally
+// changing the root directory
+package privileges
+
+import (
+	"fmt"
+	"log/slog"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/dvlahovski/go-dnscached/config"
+)
+
+// Get the uid and gid of the configured user and group.
+// The gid is the primary group of the user if no group is set.
+func lookup(cfg config.PrivilegesConfig) (int, int, error) {
+	u, err := user.Lookup(cfg.User)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %s has a non-numeric uid %s", cfg.User, u.Uid)
+	}
+
+	gidString := u.Gid
+	if cfg.Group != "" {
+		g, err := user.LookupGroup(cfg.Group)
+		if err != nil {
+			return 0, 0, err
+		}
+		gidString = g.Gid
+	}
+
+	gid, err := strconv.Atoi(gidString)
+	if err != nil {
+		return 0, 0, fmt.Errorf("group %s has a non-numeric gid %s", cfg.Group, gidString)
+	}
+
+	return uid, gid, nil
+}
+
+// Drop changes the root directory to Chroot, if set, and switches to User and
+// Group, if set. The users are looked up before changing the root directory.
+// It is meant to be called once, after binding all the listeners and opening the logs.
+func Drop(cfg config.PrivilegesConfig) error {
+	var uid, gid int
+	if cfg.User != "" {
+		var err error
+		if uid, gid, err = lookup(cfg); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Chroot != "" {
+		if err := syscall.Chroot(cfg.Chroot); err != nil {
+			return fmt.Errorf("chroot to %s: %w", cfg.Chroot, err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return err
+		}
+		slog.Info("changed root directory", "chroot", cfg.Chroot)
+	}
+
+	if cfg.User == "" {
+		return nil
+	}
+
+	// the group has to be changed while still being root
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d: %w", uid, err)
+	}
+
+	slog.Info("dropped privileges", "user", cfg.User, "uid", uid, "gid", gid)
+	return nil
+}
@@ -0,0 +1,52 @@
+package privileges
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dvlahovski/go-dnscached/config"
+)
+
+func TestLookup(t *testing.T) {
+	uid, gid, err := lookup(config.PrivilegesConfig{User: "root"})
+	if err != nil {
+		t.Fatalf("root should be found: %s", err)
+	}
+
+	if uid != 0 || gid != 0 {
+		t.Fatalf("expected 0:0 for root, got %d:%d", uid, gid)
+	}
+
+	if _, _, err := lookup(config.PrivilegesConfig{User: "root", Group: "no-such-group"}); err == nil {
+		t.Fatal("an unknown group should fail")
+	}
+
+	if _, _, err := lookup(config.PrivilegesConfig{User: "no-such-user"}); err == nil {
+		t.Fatal("an unknown user should fail")
+	}
+}
+
+func TestDropNothing(t *testing.T) {
+	if err := Drop(config.PrivilegesConfig{}); err != nil {
+		t.Fatalf("dropping nothing should succeed: %s", err)
+	}
+}
+
+func TestReadNameservers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	conf := "# generated\nnameserver 10.0.0.1\nnameserver ::1\nsearch corp.bg\nnameserver broken\n"
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	nameservers := readNameservers(path)
+	if !reflect.DeepEqual(nameservers, []string{"10.0.0.1:53", "[::1]:53"}) {
+		t.Fatalf("unexpected name servers %v", nameservers)
+	}
+
+	if readNameservers(filepath.Join(t.TempDir(), "missing")) != nil {
+		t.Fatal("a missing file should have no name servers")
+	}
+}
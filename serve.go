@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/api"
+	"github.com/dvlahovski/go-dnscached/cache"
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/logging"
+	"github.com/dvlahovski/go-dnscached/privileges"
+	"github.com/dvlahovski/go-dnscached/server"
+	"github.com/dvlahovski/go-dnscached/systemd"
+	"github.com/dvlahovski/go-dnscached/web"
+	"github.com/miekg/dns"
+)
+
+const defaultConfigPath = "config/config.json"
+
+// Print the config errors, one field per line
+func printConfigError(configPath string, err error) {
+	var errs config.ValidationErrors
+	if errors.As(err, &errs) {
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n", configPath)
+		for _, fieldErr := range errs {
+			fmt.Fprintf(os.Stderr, "  %s\n", fieldErr)
+		}
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "%s\n", err)
+}
+
+// check-config: validate the config file and print the problems
+func checkConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configPath := flags.String("config", defaultConfigPath, "path to the JSON, YAML or TOML config file")
+	flags.Parse(args)
+
+	if _, err := config.Load(*configPath); err != nil {
+		printConfigError(*configPath, err)
+		return 1
+	}
+
+	fmt.Printf("%s is valid\n", *configPath)
+	return 0
+}
+
+// the environment variable with the descriptor a detached daemon reports its start on
+const startupFdEnv = "DNSCACHED_STARTUP_FD"
+
+// the report of a detached daemon that bound all its listeners
+const startedReport = "started"
+
+// Start the daemon again in its own session, detached from the terminal, and
+// wait until it has bound its listeners or failed to
+func detach(args []string) int {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to find the executable: %s\n", err)
+		return 1
+	}
+
+	reports, reporter, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start the daemon: %s\n", err)
+		return 1
+	}
+	defer reports.Close()
+
+	cmd := exec.Command(exe, append([]string{"serve"}, args...)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.ExtraFiles = []*os.File{reporter}
+	cmd.Env = append(os.Environ(), startupFdEnv+"=3")
+	err = cmd.Start()
+	reporter.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start the daemon: %s\n", err)
+		return 1
+	}
+
+	// the daemon closes its end once it has started, or on exit
+	report, _ := io.ReadAll(reports)
+	if string(report) != startedReport {
+		if len(report) == 0 {
+			report = []byte("the daemon exited while starting, see its log")
+		}
+		fmt.Fprintf(os.Stderr, "Failed to start the daemon: %s\n", report)
+		return 1
+	}
+
+	fmt.Printf("Daemon started with pid %d\n", cmd.Process.Pid)
+	return 0
+}
+
+// startup reports the start of a detached daemon to the process that detached it
+type startup struct {
+	reporter *os.File
+}
+
+// Get the startup of the daemon, reporting to the parent if it was detached
+func newStartup() *startup {
+	s := new(startup)
+	if fd, err := strconv.Atoi(os.Getenv(startupFdEnv)); err == nil {
+		s.reporter = os.NewFile(uintptr(fd), "startup")
+		os.Unsetenv(startupFdEnv)
+	}
+
+	return s
+}
+
+// Report a line to the parent, only once
+func (s *startup) report(line string) {
+	if s.reporter == nil {
+		return
+	}
+
+	io.WriteString(s.reporter, line)
+	s.reporter.Close()
+	s.reporter = nil
+}
+
+// started reports that all the listeners are bound
+func (s *startup) started() {
+	s.report(startedReport)
+}
+
+// failed logs why the daemon couldn't start, reports it and returns the exit status
+func (s *startup) failed(message string, err error) int {
+	slog.Error(message, "err", err)
+	s.report(fmt.Sprintf("%s: %s", message, err))
+	return 1
+}
+
+// Check if the daemon is run by systemd, which needs it to stay in its process
+// for socket activation and readiness notifications
+func underSystemd() bool {
+	return os.Getenv("LISTEN_FDS") != "" || os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// serve: run the DNS server, the API and the web GUI
+func serve(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := flags.String("config", defaultConfigPath, "path to the JSON, YAML or TOML config file; empty to configure from the environment only")
+	logPath := flags.String("log", "", "log file, overriding the one in the config")
+	detached := flags.Bool("detach", false, "detach from the terminal once the listeners are bound; ignored under systemd")
+	flags.Bool("foreground", true, "stay in the foreground, the default (deprecated)")
+	checkOnly := flags.Bool("check-config", false, "validate the config file and exit (deprecated, use check-config)")
+	flags.Parse(args)
+
+	if *checkOnly {
+		return checkConfig([]string{"-config", *configPath})
+	}
+
+	config, err := config.Load(*configPath)
+	if err != nil {
+		printConfigError(*configPath, err)
+		return 1
+	}
+
+	start := newStartup()
+	if *detached && start.reporter == nil && !underSystemd() {
+		return detach(args)
+	}
+	defer start.report("the daemon exited while starting, see its log")
+
+	if *logPath != "" {
+		config.Log.File = *logPath
+	}
+
+	logFile, err := logging.Setup(config.Log)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up logging: %s\n", err)
+		start.report(fmt.Sprintf("failed to set up logging: %s", err))
+		return 1
+	}
+	defer logFile.Close()
+
+	slog.Info("daemon started", "version", version)
+	defer slog.Info("daemon shutdown")
+	slog.Debug("config loaded", "config", fmt.Sprintf("%v", config))
+
+	cache := cache.NewCache(*config)
+	if path := config.Cache.SnapshotFile; path != "" {
+		restored, err := cache.LoadSnapshot(path)
+		if err != nil {
+			slog.Warn("cache snapshot not restored", "path", path, "err", err)
+		} else {
+			slog.Info("cache snapshot restored", "path", path, "entries", restored)
+		}
+
+		// write the cache out on the way out
+		cache.OnClose(func() error {
+			return cache.WriteSnapshot(path)
+		})
+	}
+	dnsClient := new(dns.Client)
+	httpClient := &http.Client{Timeout: 15 * time.Second}
+	if config.Privileges.Chroot != "" {
+		// the CAs and the name servers of the system are out of reach after the chroot
+		preloaded, err := privileges.Preload()
+		if err != nil {
+			return start.failed("loading the system CAs failed", err)
+		}
+		httpClient.Transport = preloaded.Transport()
+	}
+	server, err := server.NewServer(cache, config, dnsClient, httpClient)
+	if err != nil {
+		return start.failed("server creation error", err)
+	}
+
+	// the web GUI is served either on the API port or on its own
+	var ui http.Handler
+	var webServer *http.Server
+	if config.Web.SharePort {
+		ui, err = web.Handler(&config.Web, &config.Api, server, cache)
+	} else {
+		webServer, err = web.New(&config.Web, &config.Api, server, cache)
+	}
+	if err != nil {
+		return start.failed("web GUI server creation error", err)
+	}
+
+	apiServer, err := api.New(server, cache, &config.Api, ui)
+	if err != nil {
+		return start.failed("REST API server creation error", err)
+	}
+	httpServers := []*http.Server{apiServer}
+
+	// bind everything before serving, using the sockets passed by systemd if any
+	sockets := systemd.Activated()
+	if err := server.Listen(sockets); err != nil {
+		return start.failed("DNS server failed to listen", err)
+	}
+
+	apiListener, err := listen(sockets, apiServer.Addr)
+	if err != nil {
+		return start.failed("REST API server failed to listen", err)
+	}
+
+	var webListener net.Listener
+	if webServer != nil {
+		webListener, err = listen(sockets, webServer.Addr)
+		if err != nil {
+			return start.failed("web GUI server failed to listen", err)
+		}
+		httpServers = append(httpServers, webServer)
+	}
+	sockets.Close()
+
+	if err := privileges.Drop(config.Privileges); err != nil {
+		return start.failed("dropping privileges failed", err)
+	}
+
+	failures := make(chan error, 3)
+	go func() {
+		if err := server.Serve(); err != nil {
+			failures <- fmt.Errorf("DNS server failed: %w", err)
+		}
+	}()
+
+	go func() {
+		slog.Info("starting REST API server", "address", apiServer.Addr, "tls", apiServer.TLSConfig != nil)
+		if err := serveHTTP(apiServer, apiListener); err != http.ErrServerClosed {
+			failures <- fmt.Errorf("REST API server failed: %w", err)
+		}
+	}()
+
+	if webServer != nil {
+		go func() {
+			slog.Info("starting web GUI server", "address", webServer.Addr, "tls", webServer.TLSConfig != nil)
+			if err := serveHTTP(webServer, webListener); err != http.ErrServerClosed {
+				failures <- fmt.Errorf("web GUI server failed: %w", err)
+			}
+		}()
+	} else {
+		slog.Info("serving the web GUI on the REST API server", "path", "/ui/")
+	}
+
+	systemd.Ready()
+	start.started()
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	defer stopWatchdog()
+	go systemd.Watchdog(watchdogCtx)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	status := 0
+wait:
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				slog.Info("caught signal, reloading config", "signal", sig)
+				if err := server.Reload(); err != nil {
+					slog.Error("config reload failed", "err", err)
+				}
+				continue
+			}
+
+			slog.Info("caught signal", "signal", sig)
+			break wait
+		case err := <-failures:
+			slog.Error("shutting down after failure", "err", err)
+			status = 1
+			break wait
+		}
+	}
+
+	systemd.Stopping()
+
+	// the timeout may have been changed by a reload
+	timeout := time.Duration(server.Config().Server.ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := shutdown(ctx, server, cache, httpServers...); err != nil {
+		slog.Error("shutdown error", "err", err)
+		return 1
+	}
+
+	return status
+}
+
+// serve HTTP, or HTTPS if the server has a TLS config
+func serveHTTP(s *http.Server, listener net.Listener) error {
+	if s.TLSConfig != nil {
+		return s.ServeTLS(listener, "", "")
+	}
+
+	return s.Serve(listener)
+}
+
+// Take the activated socket bound to address, or bind it
+func listen(sockets *systemd.Sockets, address string) (net.Listener, error) {
+	if listener := sockets.Listener(address); listener != nil {
+		return listener, nil
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// Stop the DNS server and the HTTP servers, letting their in-flight requests
+// finish until ctx is done, then close the cache
+func shutdown(ctx context.Context, dnsServer *server.Server, c *cache.Cache, httpServers ...*http.Server) error {
+	errs := make(chan error, len(httpServers)+1)
+	go func() {
+		errs <- dnsServer.ShutdownContext(ctx)
+	}()
+
+	for _, httpServer := range httpServers {
+		go func(httpServer *http.Server) {
+			errs <- httpServer.Shutdown(ctx)
+		}(httpServer)
+	}
+
+	var err error
+	for i := 0; i < cap(errs); i++ {
+		err = errors.Join(err, <-errs)
+	}
+
+	return errors.Join(err, c.Close())
+}
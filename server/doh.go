@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// maximum size of a DNS message
+const maxMsgSize = 65535
+
+// dohHandler serves DNS over HTTPS requests (RFC 8484) with a dns.Handler
+type dohHandler struct {
+	handler dns.Handler
+	local   net.Addr
+}
+
+// Read the DNS message of a GET (?dns=<base64url>) or POST (application/dns-message) request
+func readDohRequest(req *http.Request) ([]byte, int) {
+	switch req.Method {
+	case http.MethodGet:
+		raw, err := base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		if err != nil || len(raw) == 0 {
+			return nil, http.StatusBadRequest
+		}
+
+		return raw, http.StatusOK
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != "application/dns-message" {
+			return nil, http.StatusUnsupportedMediaType
+		}
+
+		raw, err := io.ReadAll(io.LimitReader(req.Body, maxMsgSize))
+		if err != nil || len(raw) == 0 {
+			return nil, http.StatusBadRequest
+		}
+
+		return raw, http.StatusOK
+	}
+
+	return nil, http.StatusMethodNotAllowed
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	raw, status := readDohRequest(req)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(raw); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	writer := &dohWriter{w: w, local: h.local}
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		writer.remote = addr
+	}
+
+	h.handler.ServeDNS(writer, msg)
+
+	if !writer.written {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// dohWriter is a dns.ResponseWriter writing the reply in a DNS over HTTPS response
+type dohWriter struct {
+	w       http.ResponseWriter
+	local   net.Addr
+	remote  net.Addr
+	written bool
+}
+
+func (d *dohWriter) LocalAddr() net.Addr {
+	return d.local
+}
+
+func (d *dohWriter) RemoteAddr() net.Addr {
+	return d.remote
+}
+
+func (d *dohWriter) WriteMsg(msg *dns.Msg) error {
+	raw, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Write(raw)
+	return err
+}
+
+func (d *dohWriter) Write(raw []byte) (int, error) {
+	d.written = true
+	d.w.Header().Set("Content-Type", "application/dns-message")
+	return d.w.Write(raw)
+}
+
+func (d *dohWriter) Close() error {
+	return nil
+}
+
+func (d *dohWriter) TsigStatus() error {
+	return nil
+}
+
+func (d *dohWriter) TsigTimersOnly(bool) {}
+
+func (d *dohWriter) Hijack() {}
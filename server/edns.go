@@ -0,0 +1,141 @@
+package server
+
+import (
+	"net"
+	"slices"
+
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/miekg/dns"
+)
+
+// clientEdns is the EDNS0 state of a client request
+type clientEdns struct {
+	// the request has an OPT record
+	enabled bool
+	version uint8
+	// the DNSSEC OK bit
+	do bool
+	// the largest UDP reply the client accepts
+	udpSize uint16
+	// the options of the request that are forwarded to the upstreams
+	options []dns.EDNS0
+}
+
+// Get the EDNS0 state of a client request. Without an OPT record the client
+// gets at most 512 bytes over UDP.
+func newClientEdns(request *dns.Msg, cfg config.EdnsConfig) clientEdns {
+	opt := request.IsEdns0()
+	if opt == nil {
+		return clientEdns{udpSize: dns.MinMsgSize}
+	}
+
+	e := clientEdns{
+		enabled: true,
+		version: opt.Version(),
+		do:      opt.Do(),
+		udpSize: max(opt.UDPSize(), dns.MinMsgSize),
+		options: forwardedOptions(opt, cfg),
+	}
+	e.udpSize = min(e.udpSize, uint16(cfg.UDPSize))
+
+	return e
+}
+
+// Get the options of an OPT record that are configured to be forwarded
+func forwardedOptions(opt *dns.OPT, cfg config.EdnsConfig) []dns.EDNS0 {
+	var options []dns.EDNS0
+	for _, option := range opt.Option {
+		if slices.Contains(cfg.ForwardOptions, int(option.Option())) {
+			options = append(options, option)
+		}
+	}
+
+	return options
+}
+
+// Build the OPT record of an upstream request with the payload size of the
+// server, the DO bit if dnssec is set and the forwarded options of the client
+func upstreamOpt(client clientEdns, dnssec bool, cfg config.EdnsConfig) *dns.OPT {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(uint16(cfg.UDPSize))
+	if dnssec {
+		opt.SetDo()
+	}
+	opt.Option = client.options
+
+	return opt
+}
+
+// Copy a response for the cache, without the forwarded options of its OPT
+// record, which answer the client that asked for it and no other
+func cacheable(response *dns.Msg) dns.Msg {
+	cached := response.Copy()
+	if opt := cached.IsEdns0(); opt != nil {
+		opt.Option = nil
+	}
+
+	return *cached
+}
+
+// the records that are left out of the replies to clients without the DO bit,
+// unless asked for
+var dnssecTypes = []uint16{dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3}
+
+// Copy the records of a response, without its OPT record and, unless the
+// client set the DO bit, without the DNSSEC records it didn't ask for
+func copyRecords(records []dns.RR, client clientEdns, qtype uint16) []dns.RR {
+	copied := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		rrtype := rr.Header().Rrtype
+		if rrtype == dns.TypeOPT {
+			continue
+		}
+		if !client.do && rrtype != qtype && slices.Contains(dnssecTypes, rrtype) {
+			continue
+		}
+		copied = append(copied, rr)
+	}
+
+	return copied
+}
+
+// Copy the sections of an upstream or cached response to the reply of a client
+func fillReply(reply *dns.Msg, response *dns.Msg, client clientEdns) {
+	var qtype uint16
+	if len(reply.Question) > 0 {
+		qtype = reply.Question[0].Qtype
+	}
+
+	reply.Answer = copyRecords(response.Answer, client, qtype)
+	reply.Ns = copyRecords(response.Ns, client, qtype)
+	reply.Extra = copyRecords(response.Extra, client, qtype)
+}
+
+// Write the reply of a client request. A client that sent an OPT record gets
+// one back, echoing its DO bit, with the forwarded options of the upstream
+// response if there is one; cached responses have none. UDP replies are truncated to the size the client accepts.
+func (s *Server) writeReply(w dns.ResponseWriter, reply *dns.Msg, client clientEdns, response *dns.Msg) error {
+	cfg := s.Config().Server.Edns
+	if client.enabled {
+		opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(uint16(cfg.UDPSize))
+		if client.do {
+			opt.SetDo()
+		}
+		if response != nil {
+			if responseOpt := response.IsEdns0(); responseOpt != nil {
+				opt.Option = forwardedOptions(responseOpt, cfg)
+			}
+		}
+		reply.Extra = append(reply.Extra, opt)
+	} else if reply.Rcode > 0xF {
+		// extended rcodes can't be sent without an OPT record
+		reply.Rcode = dns.RcodeServerFailure
+	}
+
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		reply.Truncate(int(client.udpSize))
+	}
+
+	return w.WriteMsg(reply)
+}
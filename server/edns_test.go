@@ -0,0 +1,243 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/cache"
+	"github.com/dvlahovski/go-dnscached/test"
+	"github.com/miekg/dns"
+)
+
+// recordingDnsClient keeps the last upstream request and answers it with reply
+type recordingDnsClient struct {
+	request *dns.Msg
+	reply   *dns.Msg
+}
+
+func (c *recordingDnsClient) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	c.request = m
+	reply := c.reply.Copy()
+	reply.Id = m.Id
+	return reply, 0, nil
+}
+
+// udpResponseWriter is a response writer of a UDP client
+type udpResponseWriter struct {
+	test.StubResponseWriter
+}
+
+func (w *udpResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func getEdnsServer(t *testing.T, reply *dns.Msg, forwardOptions ...int) (*Server, *recordingDnsClient) {
+	cfg := test.GetStubConfig()
+	cfg.Server.Edns.ForwardOptions = forwardOptions
+	dnsClient := &recordingDnsClient{reply: reply}
+
+	server, err := NewServer(cache.NewCache(*cfg), cfg, dnsClient, &http.Client{})
+	if err != nil {
+		t.Fatalf("server creation error: %s", err)
+	}
+
+	return server, dnsClient
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// Get a signed upstream answer with an OPT record carrying a subnet and a cookie option
+func signedAnswer(t *testing.T) *dns.Msg {
+	msg := test.GetDnsMsgAnswer()
+	msg.Answer = append(msg.Answer, mustRR(t, "google.bg. 300 IN RRSIG A 8 2 300 20300101000000 20200101000000 12345 google.bg. AAAA"))
+	msg.SetEdns0(1232, true)
+	opt := msg.IsEdns0()
+	opt.Option = []dns.EDNS0{
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(10, 0, 0, 0)},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+	}
+	return msg
+}
+
+func hasOption(opt *dns.OPT, code uint16) bool {
+	for _, option := range opt.Option {
+		if option.Option() == code {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(records []dns.RR, rrtype uint16) bool {
+	for _, rr := range records {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEdnsWithoutOpt(t *testing.T) {
+	server, dnsClient := getEdnsServer(t, signedAnswer(t))
+	w := new(test.StubResponseWriter)
+	server.HandleRequest(w, test.GetDnsMsgQuestion())
+
+	// the upstreams are asked with the payload size and the DO bit of the server
+	opt := dnsClient.request.IsEdns0()
+	if opt == nil || opt.UDPSize() != 1232 || !opt.Do() || len(opt.Option) != 0 {
+		t.Fatalf("unexpected upstream OPT record %v", opt)
+	}
+
+	if w.Msg.IsEdns0() != nil {
+		t.Error("a client without EDNS0 should get no OPT record")
+	}
+	if hasType(w.Msg.Answer, dns.TypeRRSIG) || len(w.Msg.Answer) != 1 {
+		t.Errorf("a client without the DO bit should get no signatures, got %v", w.Msg.Answer)
+	}
+}
+
+func TestEdnsDoAndOptions(t *testing.T) {
+	server, dnsClient := getEdnsServer(t, signedAnswer(t), dns.EDNS0SUBNET)
+
+	request := test.GetDnsMsgQuestion()
+	request.SetEdns0(4096, true)
+	request.IsEdns0().Option = []dns.EDNS0{
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(192, 168, 1, 0)},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "1112131415161718"},
+	}
+
+	for _, cached := range []bool{false, true} {
+		w := new(test.StubResponseWriter)
+		server.HandleRequest(w, request)
+
+		if !cached {
+			opt := dnsClient.request.IsEdns0()
+			if !hasOption(opt, dns.EDNS0SUBNET) || hasOption(opt, dns.EDNS0COOKIE) {
+				t.Errorf("only the subnet option should be forwarded, got %v", opt.Option)
+			}
+		}
+
+		opt := w.Msg.IsEdns0()
+		if opt == nil || !opt.Do() || opt.UDPSize() != 1232 {
+			t.Fatalf("cached %t: expected an OPT record with the DO bit, got %v", cached, opt)
+		}
+		if hasOption(opt, dns.EDNS0SUBNET) == cached || hasOption(opt, dns.EDNS0COOKIE) {
+			t.Errorf("cached %t: only the subnet option of the upstream response should be returned, got %v", cached, opt.Option)
+		}
+		if !hasType(w.Msg.Answer, dns.TypeRRSIG) {
+			t.Errorf("cached %t: a client with the DO bit should get the signatures", cached)
+		}
+		if len(w.Msg.Extra) != 1 {
+			t.Errorf("cached %t: expected only the OPT record in the additional section, got %v", cached, w.Msg.Extra)
+		}
+	}
+}
+
+func TestEdnsOptionsOfOtherClients(t *testing.T) {
+	server, _ := getEdnsServer(t, signedAnswer(t), dns.EDNS0SUBNET)
+
+	// the first client gets the answer of the upstream for its subnet,
+	// the second one the cached answer without it
+	for i, subnet := range []net.IP{net.IPv4(192, 168, 1, 0), net.IPv4(172, 16, 0, 0)} {
+		request := test.GetDnsMsgQuestion()
+		request.SetEdns0(4096, false)
+		request.IsEdns0().Option = []dns.EDNS0{
+			&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: subnet},
+		}
+
+		w := new(test.StubResponseWriter)
+		server.HandleRequest(w, request)
+
+		if hasOption(w.Msg.IsEdns0(), dns.EDNS0SUBNET) != (i == 0) {
+			t.Errorf("client %s: unexpected options %v", subnet, w.Msg.IsEdns0().Option)
+		}
+	}
+
+	entry, _ := server.cache.GetEntry("google.bg.A.")
+	if opt := entry.Value.IsEdns0(); opt == nil || len(opt.Option) != 0 {
+		t.Errorf("the cached response should keep its OPT record without the options, got %v", opt)
+	}
+}
+
+func TestEdnsPassThrough(t *testing.T) {
+	reply := new(dns.Msg)
+	reply.Answer = []dns.RR{mustRR(t, "google.bg. 300 IN MX 10 mail.google.bg.")}
+	server, dnsClient := getEdnsServer(t, reply)
+
+	request := new(dns.Msg)
+	request.SetQuestion("google.bg.", dns.TypeMX)
+	request.SetEdns0(1232, false)
+	server.HandleRequest(new(test.StubResponseWriter), request)
+
+	if opt := dnsClient.request.IsEdns0(); opt == nil || opt.Do() {
+		t.Fatalf("the DO bit of the client should be forwarded as is, got %v", opt)
+	}
+}
+
+func TestEdnsBadVersion(t *testing.T) {
+	server, dnsClient := getEdnsServer(t, test.GetDnsMsgAnswer())
+
+	request := test.GetDnsMsgQuestion()
+	request.SetEdns0(1232, false)
+	request.IsEdns0().SetVersion(1)
+	w := new(test.StubResponseWriter)
+	server.HandleRequest(w, request)
+
+	if w.Msg.Rcode != dns.RcodeBadVers || w.Msg.IsEdns0() == nil {
+		t.Fatalf("expected BADVERS with an OPT record, got %s", dns.RcodeToString[w.Msg.Rcode])
+	}
+	if dnsClient.request != nil {
+		t.Error("a request of an unknown EDNS version should not be forwarded")
+	}
+	if _, err := w.Msg.Pack(); err != nil {
+		t.Errorf("the reply can't be packed: %s", err)
+	}
+}
+
+func TestEdnsTruncation(t *testing.T) {
+	reply := test.GetDnsMsgAnswer()
+	reply.Answer = nil
+	for i := 0; i < 60; i++ {
+		reply.Answer = append(reply.Answer, mustRR(t, fmt.Sprintf("google.bg. 300 IN A 10.0.0.%d", i)))
+	}
+
+	cases := []struct {
+		udpSize   uint16
+		truncated bool
+	}{
+		// 60 A records are about 1 KB
+		{0, true},
+		{4096, false},
+	}
+
+	for _, c := range cases {
+		server, _ := getEdnsServer(t, reply)
+		request := test.GetDnsMsgQuestion()
+		if c.udpSize != 0 {
+			request.SetEdns0(c.udpSize, false)
+		}
+
+		w := new(udpResponseWriter)
+		server.HandleRequest(w, request)
+
+		packed, err := w.Msg.Pack()
+		if err != nil {
+			t.Fatalf("the reply can't be packed: %s", err)
+		}
+		if w.Msg.Truncated != c.truncated {
+			t.Errorf("payload size %d: expected truncated %t, got %t", c.udpSize, c.truncated, w.Msg.Truncated)
+		}
+		if c.udpSize == 0 && len(packed) > dns.MinMsgSize {
+			t.Errorf("a client without EDNS0 got %d bytes over UDP", len(packed))
+		}
+	}
+}
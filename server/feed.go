@@ -0,0 +1,63 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/dvlahovski/go-dnscached/logging"
+)
+
+// feedBufferSize is the number of queries buffered for each subscriber.
+// Queries are dropped for subscribers that fall behind.
+const feedBufferSize = 64
+
+// Feed broadcasts every handled client query to its subscribers
+type Feed struct {
+	lock        sync.Mutex
+	subscribers map[chan logging.QueryEntry]struct{}
+}
+
+func newFeed() *Feed {
+	return &Feed{subscribers: make(map[chan logging.QueryEntry]struct{})}
+}
+
+// Subscribe returns a channel receiving the queries handled from now on
+func (f *Feed) Subscribe() chan logging.QueryEntry {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ch := make(chan logging.QueryEntry, feedBufferSize)
+	f.subscribers[ch] = struct{}{}
+	return ch
+}
+
+// Unsubscribe stops sending queries to the channel and closes it
+func (f *Feed) Unsubscribe(ch chan logging.QueryEntry) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.subscribers[ch]; ok {
+		delete(f.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Send the query to all the subscribers without blocking
+func (f *Feed) publish(entry logging.QueryEntry) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for ch := range f.subscribers {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+}
+
+// Check if anyone is listening so the entry is not built needlessly
+func (f *Feed) active() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.subscribers) > 0
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/certs"
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/systemd"
+	"github.com/miekg/dns"
+)
+
+// the timeouts of the DoH connections, in line with the ones of the DNS over TCP
+// connections of dns.Server, so slow clients can't hold on to them
+const (
+	dohReadTimeout = 2 * time.Second
+	dohIdleTimeout = 8 * time.Second
+)
+
+// listener serves DNS requests on one address with one protocol.
+// udp, tcp and dot are served by a dns.Server, doh by an http.Server.
+type listener struct {
+	address  string
+	protocol string
+	tls      *tls.Config
+	dns      *dns.Server
+	http     *http.Server
+	socket   net.Listener
+}
+
+// protocolWriter is the response writer of a listener, telling the
+// handler which protocol the request arrived over
+type protocolWriter struct {
+	dns.ResponseWriter
+	protocol string
+}
+
+// Get the listener protocol of a request: the one of its listener, or else
+// udp or tcp from the address of the client
+func listenerProtocol(w dns.ResponseWriter) string {
+	if p, ok := w.(*protocolWriter); ok {
+		return p.protocol
+	}
+
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return config.ListenerTCP
+	}
+
+	return config.ListenerUDP
+}
+
+// Get a new listener for the address and protocol of the config
+func newListener(cfg config.ListenerConfig, address string, handler dns.Handler) (*listener, error) {
+	l := &listener{address: address, protocol: cfg.Protocol}
+	next := handler
+	handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		next.ServeDNS(&protocolWriter{ResponseWriter: w, protocol: cfg.Protocol}, r)
+	})
+
+	if cfg.Protocol == config.ListenerDoT || cfg.Protocol == config.ListenerDoH {
+		reloader, err := certs.New(config.TLSConfig{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile})
+		if err != nil {
+			return nil, err
+		}
+		l.tls = reloader.TLSConfig()
+	}
+
+	switch cfg.Protocol {
+	case config.ListenerUDP:
+		l.dns = &dns.Server{Addr: address, Net: "udp", Handler: handler}
+	case config.ListenerTCP:
+		l.dns = &dns.Server{Addr: address, Net: "tcp", Handler: handler}
+	case config.ListenerDoT:
+		l.dns = &dns.Server{Addr: address, Net: "tcp-tls", Handler: handler}
+	case config.ListenerDoH:
+		local, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle(cfg.Path, &dohHandler{handler: handler, local: local})
+		l.http = &http.Server{
+			Addr:              address,
+			Handler:           mux,
+			ReadHeaderTimeout: dohReadTimeout,
+			ReadTimeout:       dohReadTimeout,
+			IdleTimeout:       dohIdleTimeout,
+		}
+		// offer HTTP/2, which DoH clients prefer, along with HTTP/1.1.
+		// The per-connection configs of the reloader are cloned from this one.
+		l.tls.NextProtos = []string{"h2", "http/1.1"}
+	default:
+		return nil, fmt.Errorf("unknown listener protocol %q", cfg.Protocol)
+	}
+
+	return l, nil
+}
+
+// Bind the address of the listener, or take its socket from the activated sockets
+func (l *listener) Listen(sockets *systemd.Sockets) error {
+	if l.protocol == config.ListenerUDP {
+		conn := sockets.PacketConn(l.address)
+		activated := conn != nil
+		if !activated {
+			var err error
+			if conn, err = net.ListenPacket("udp", l.address); err != nil {
+				return err
+			}
+		}
+
+		slog.Info("server listening", "address", l.address, "protocol", l.protocol, "activated", activated)
+		l.dns.PacketConn = conn
+		return nil
+	}
+
+	socket := sockets.Listener(l.address)
+	activated := socket != nil
+	if !activated {
+		var err error
+		if socket, err = net.Listen("tcp", l.address); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("server listening", "address", l.address, "protocol", l.protocol, "activated", activated)
+	if l.tls != nil {
+		socket = tls.NewListener(socket, l.tls)
+	}
+
+	if l.http != nil {
+		l.socket = socket
+	} else {
+		l.dns.Listener = socket
+	}
+
+	return nil
+}
+
+// Serve on the bound socket until the listener is shut down
+func (l *listener) Serve() error {
+	if l.http != nil {
+		if err := l.http.Serve(l.socket); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	}
+
+	return l.dns.ActivateAndServe()
+}
+
+// Stop serving and wait for the in-flight requests until ctx is done
+func (l *listener) Shutdown(ctx context.Context) error {
+	if l.http != nil {
+		return l.http.Shutdown(ctx)
+	}
+
+	return l.dns.ShutdownContext(ctx)
+}
+
+// Get the addresses to listen on for a listener config.
+// A listener on an interface is expanded to all the addresses of the interface.
+func listenerAddresses(cfg config.ListenerConfig) ([]string, error) {
+	if cfg.Interface == "" {
+		return []string{cfg.Address}, nil
+	}
+
+	_, port, err := net.SplitHostPort(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	iface, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		host := ipNet.IP.String()
+		// link-local IPv6 addresses are only unique with the interface
+		if ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+			host += "%" + iface.Name
+		}
+		addresses = append(addresses, net.JoinHostPort(host, port))
+	}
+
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("interface %s has no addresses", cfg.Interface)
+	}
+
+	return addresses, nil
+}
+
+// listenerSet is all the listeners of the server
+type listenerSet []*listener
+
+// Get the listeners of the server config, handling the requests with handler
+func newListenerSet(cfg config.ServerConfig, handler dns.Handler) (listenerSet, error) {
+	var set listenerSet
+	for _, listenerCfg := range cfg.AllListeners() {
+		addresses, err := listenerAddresses(listenerCfg)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, address := range addresses {
+			l, err := newListener(listenerCfg, address, handler)
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, l)
+		}
+	}
+
+	if len(set) == 0 {
+		return nil, fmt.Errorf("no addresses to listen on")
+	}
+
+	return set, nil
+}
+
+// Bind all the listeners, using the activated sockets where they match
+func (set listenerSet) Listen(sockets *systemd.Sockets) error {
+	for _, l := range set {
+		if err := l.Listen(sockets); err != nil {
+			return fmt.Errorf("%s %s: %w", l.protocol, l.address, err)
+		}
+	}
+
+	return nil
+}
+
+// Serve on all the bound listeners. It returns when one of them fails or all of them are shut down.
+func (set listenerSet) Serve() error {
+	errs := make(chan error, len(set))
+	for _, l := range set {
+		go func(l *listener) {
+			if err := l.Serve(); err != nil {
+				errs <- fmt.Errorf("%s %s: %w", l.protocol, l.address, err)
+				return
+			}
+			errs <- nil
+		}(l)
+	}
+
+	for range set {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Shut down all the listeners, waiting for the in-flight requests until ctx is done
+func (set listenerSet) Shutdown(ctx context.Context) error {
+	errs := make(chan error, len(set))
+	for _, l := range set {
+		go func(l *listener) {
+			errs <- l.Shutdown(ctx)
+		}(l)
+	}
+
+	var err error
+	for range set {
+		err = errors.Join(err, <-errs)
+	}
+
+	return err
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/test"
+	"github.com/miekg/dns"
+)
+
+// answer every question with an empty reply
+var replyHandler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetReply(r)
+	w.WriteMsg(reply)
+})
+
+func TestListenerSet(t *testing.T) {
+	cfg := config.ServerConfig{
+		Address: "127.0.0.1:15301",
+		Listeners: []config.ListenerConfig{
+			{Address: "[::1]:15302", Protocol: config.ListenerUDP},
+			{Address: "127.0.0.1:15303", Protocol: config.ListenerTCP},
+		},
+	}
+
+	set, err := newListenerSet(cfg, replyHandler)
+	if err != nil {
+		t.Fatalf("listener set creation error: %s", err)
+	}
+
+	if len(set) != 3 {
+		t.Fatalf("expected 3 listeners, got %d", len(set))
+	}
+
+	errors := make(chan error, 1)
+	go func() {
+		if err := set.Listen(nil); err != nil {
+			errors <- err
+			return
+		}
+		errors <- set.Serve()
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("google.bg.", dns.TypeA)
+	for _, l := range set {
+		client := &dns.Client{Net: l.protocol}
+		if _, _, err := client.Exchange(msg, l.address); err != nil {
+			t.Errorf("%s %s should answer: %s", l.protocol, l.address, err)
+		}
+	}
+
+	if err := set.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown error: %s", err)
+	}
+
+	select {
+	case err := <-errors:
+		if err != nil {
+			t.Fatalf("Serve should return nil after shutdown, got %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve should return after shutdown")
+	}
+}
+
+func TestListenerOnUnknownInterface(t *testing.T) {
+	cfg := config.ServerConfig{
+		Listeners: []config.ListenerConfig{
+			{Address: ":15304", Protocol: config.ListenerUDP, Interface: "nonexistent0"},
+		},
+	}
+
+	if _, err := newListenerSet(cfg, replyHandler); err == nil {
+		t.Fatal("listening on an unknown interface should fail")
+	}
+}
+
+func TestDohHandler(t *testing.T) {
+	handler := &dohHandler{handler: replyHandler}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("google.bg.", dns.TypeA)
+	raw, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(raw), nil),
+		httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(raw)),
+	}
+	requests[1].Header.Set("Content-Type", "application/dns-message")
+
+	for _, req := range requests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/dns-message" {
+			t.Fatalf("%s: unexpected response %d %s", req.Method, w.Code, w.Header().Get("Content-Type"))
+		}
+
+		reply := new(dns.Msg)
+		if err := reply.Unpack(w.Body.Bytes()); err != nil || reply.Id != msg.Id {
+			t.Fatalf("%s: the reply should answer the query", req.Method)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(raw)))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("a POST without a DNS message should be rejected, got %d", w.Code)
+	}
+}
+
+func TestDohOverHTTP2(t *testing.T) {
+	certs := test.WriteCert(t, t.TempDir(), "doh")
+	cfg := config.ListenerConfig{Protocol: config.ListenerDoH, Path: "/dns-query", CertFile: certs.CertFile, KeyFile: certs.KeyFile}
+
+	l, err := newListener(cfg, "127.0.0.1:15305", replyHandler)
+	if err != nil {
+		t.Fatalf("listener creation error: %s", err)
+	}
+	if err := l.Listen(nil); err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	go l.Serve()
+	defer l.Shutdown(context.Background())
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("google.bg.", dns.TypeA)
+	raw, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Post("https://127.0.0.1:15305/dns-query", "application/dns-message", bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("DoH request error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("expected a 200 over HTTP/2, got %d over %s", resp.StatusCode, resp.Proto)
+	}
+}
+
+func TestDohSlowClient(t *testing.T) {
+	certs := test.WriteCert(t, t.TempDir(), "doh")
+	cfg := config.ListenerConfig{Protocol: config.ListenerDoH, Path: "/dns-query", CertFile: certs.CertFile, KeyFile: certs.KeyFile}
+
+	l, err := newListener(cfg, "127.0.0.1:15307", replyHandler)
+	if err != nil {
+		t.Fatalf("listener creation error: %s", err)
+	}
+	if err := l.Listen(nil); err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	go l.Serve()
+	defer l.Shutdown(context.Background())
+
+	// a client that never sends anything
+	conn, err := net.Dial("tcp", "127.0.0.1:15307")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(dohReadTimeout + 2*time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("the listener should drop a client that sends nothing")
+	}
+}
+
+func TestListenerProtocol(t *testing.T) {
+	var got string
+	l, err := newListener(config.ListenerConfig{Protocol: config.ListenerTCP}, "127.0.0.1:15306", dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		got = listenerProtocol(w)
+	}))
+	if err != nil {
+		t.Fatalf("listener creation error: %s", err)
+	}
+
+	l.dns.Handler.ServeDNS(new(test.StubResponseWriter), new(dns.Msg))
+	if got != config.ListenerTCP {
+		t.Fatalf("the handler should get the protocol of the listener, got %q", got)
+	}
+
+	if protocol := listenerProtocol(new(test.StubResponseWriter)); protocol != config.ListenerUDP {
+		t.Fatalf("a writer without a listener should default to udp, got %q", protocol)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/logging"
+	"github.com/miekg/dns"
+)
+
+// responseRecorder wraps a dns.ResponseWriter and keeps the written reply
+// and how it was obtained so that it can be inspected after the request is handled
+type responseRecorder struct {
+	dns.ResponseWriter
+	// the listener protocol the request arrived over
+	protocol    string
+	start       time.Time
+	reply       *dns.Msg
+	cached      bool
+	passThrough bool
+	upstream    string
+}
+
+func newResponseRecorder(w dns.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, protocol: listenerProtocol(w), start: time.Now()}
+}
+
+// WriteMsg records the reply and passes it to the underlying writer
+func (r *responseRecorder) WriteMsg(msg *dns.Msg) error {
+	r.reply = msg
+	return r.ResponseWriter.WriteMsg(msg)
+}
+
+// rcode returns the response code of the written reply as a string
+func (r *responseRecorder) rcode() string {
+	if r.reply == nil {
+		return "NONE"
+	}
+
+	if rcode, ok := dns.RcodeToString[r.reply.Rcode]; ok {
+		return rcode
+	}
+
+	return "UNKNOWN"
+}
+
+// cacheStatus returns whether the reply came from the cache as a query log status
+func (r *responseRecorder) cacheStatus() string {
+	if r.passThrough {
+		return logging.CachePassThrough
+	}
+
+	if r.cached {
+		return logging.CacheHit
+	}
+
+	return logging.CacheMiss
+}
+
+// client returns the IP address of the client the reply is written to
+func (r *responseRecorder) client() string {
+	addr := r.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// Get the query type of a request as a string
+func qtypeString(request *dns.Msg) string {
+	if len(request.Question) == 0 {
+		return "NONE"
+	}
+
+	return dns.Type(request.Question[0].Qtype).String()
+}
@@ -2,17 +2,26 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/dvlahovski/go-dnscached/cache"
 	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/logging"
+	"github.com/dvlahovski/go-dnscached/metrics"
+	"github.com/dvlahovski/go-dnscached/stats"
+	"github.com/dvlahovski/go-dnscached/systemd"
+	"github.com/dvlahovski/go-dnscached/tap"
 	"github.com/miekg/dns"
 )
 
@@ -25,67 +34,244 @@ type HttpClient interface {
 }
 
 // servers is the list of DNS servers that we forward to/ask
+// lock guards the fields that change on config reload
 type Server struct {
-	server       *dns.Server
-	cache        *cache.Cache
+	listeners listenerSet
+	cache     *cache.Cache
+	lock      sync.RWMutex
+	// serializes the applies of new configs
+	applyLock    sync.Mutex
+	config       *config.Config
 	servers      []net.UDPAddr
 	serversHttps []string
 	dnsClient    DnsClient
 	httpClient   HttpClient
+	stats        *stats.Stats
+	queryLog     *logging.QueryLogger
+	tap          *tap.Tap
+	feed         *Feed
 }
 
 // Get a new server ready to start serving
 func NewServer(cache *cache.Cache, config *config.Config, dnsClient DnsClient, httpClient HttpClient) (*Server, error) {
 	s := new(Server)
-	addr, err := net.ResolveUDPAddr("udp", config.Server.Address)
+	var err error
+	s.listeners, err = newListenerSet(config.Server, dns.HandlerFunc(s.HandleRequest))
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("Server listening at %s", addr.String())
-	s.server = &dns.Server{Addr: addr.String(), Net: "udp"}
+	s.servers, err = resolveServers(config.Server.Servers)
+	if err != nil {
+		return nil, err
+	}
+
+	s.serversHttps = make([]string, len(config.Server.ServersHTTPS))
+	copy(s.serversHttps, config.Server.ServersHTTPS)
+	s.config = config
+
+	s.cache = cache
+	s.dnsClient = dnsClient
+	s.httpClient = httpClient
+	s.stats = stats.New(config.Stats)
+	s.feed = newFeed()
+
+	if config.QueryLog.Enabled {
+		s.queryLog, err = logging.NewQueryLogger(config.QueryLog)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	if len(config.Server.Servers) <= 0 {
+	if config.Dnstap.Enabled {
+		s.tap, err = tap.New(config.Dnstap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Resolve the addresses of the DNS servers from the config
+func resolveServers(addresses []string) ([]net.UDPAddr, error) {
+	if len(addresses) <= 0 {
 		return nil, fmt.Errorf("no dns servers to use")
 	}
 
-	s.servers = make([]net.UDPAddr, len(config.Server.Servers))
-	for i, addr := range config.Server.Servers {
+	servers := make([]net.UDPAddr, len(addresses))
+	for i, addr := range addresses {
 		udpAddr, err := net.ResolveUDPAddr("udp", addr)
 		if err != nil {
 			return nil, err
 		}
 
-		s.servers[i] = *udpAddr
+		servers[i] = *udpAddr
 	}
 
-	s.serversHttps = make([]string, len(config.Server.ServersHTTPS))
-	copy(s.serversHttps, config.Server.ServersHTTPS)
+	return servers, nil
+}
 
-	s.cache = cache
-	s.dnsClient = dnsClient
-	s.httpClient = httpClient
+// Config returns the config the server is currently running with
+func (s *Server) Config() *config.Config {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-	return s, nil
+	return s.config
+}
+
+// Reload re-reads the config file the server was started with and applies it
+func (s *Server) Reload() error {
+	path := s.Config().Path()
+	if path == "" {
+		return fmt.Errorf("config was not loaded from a file")
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+
+	return s.Apply(cfg)
+}
+
+// Apply switches the server and its cache to a new config
+// without dropping the cache or the listening socket.
+// The listening address, query log and dnstap output only change on restart.
+func (s *Server) Apply(cfg *config.Config) error {
+	s.applyLock.Lock()
+	defer s.applyLock.Unlock()
+
+	return s.apply(cfg)
+}
+
+// Apply a new config, with the apply lock held
+func (s *Server) apply(cfg *config.Config) error {
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return errs
+	}
+
+	servers, err := resolveServers(cfg.Server.Servers)
+	if err != nil {
+		return err
+	}
+
+	serversHttps := make([]string, len(cfg.Server.ServersHTTPS))
+	copy(serversHttps, cfg.Server.ServersHTTPS)
+
+	s.lock.Lock()
+	old := s.config
+	s.servers = servers
+	s.serversHttps = serversHttps
+	s.config = cfg
+	s.lock.Unlock()
+
+	if !reflect.DeepEqual(old.Server.AllListeners(), cfg.Server.AllListeners()) {
+		slog.Warn("listener changes require a restart")
+	}
+
+	s.cache.Reload(*cfg)
+
+	slog.Info("config applied", "path", cfg.Path())
+	return nil
+}
+
+// ErrNotStored is returned by Update when the new config is applied
+// but its file couldn't be replaced, so it is lost on restart
+var ErrNotStored = errors.New("config applied but not stored")
+
+// Update applies a new config and stores it in the file the current config was loaded from.
+// The config is written before it is applied, so one that can't be stored isn't applied.
+func (s *Server) Update(cfg *config.Config) error {
+	s.applyLock.Lock()
+	defer s.applyLock.Unlock()
+
+	cfg.Inherit(s.Config())
+	cfg.SetDefaults()
+
+	staged, err := cfg.Stage()
+	if err != nil {
+		return fmt.Errorf("config can't be stored: %s", err)
+	}
+
+	if err := s.apply(cfg); err != nil {
+		staged.Abort()
+		return err
+	}
+
+	if err := staged.Commit(); err != nil {
+		return fmt.Errorf("%w: %s", ErrNotStored, err)
+	}
+
+	return nil
+}
+
+// Get the current DNS servers to forward to
+func (s *Server) upstreams() ([]net.UDPAddr, []string) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.servers, s.serversHttps
+}
+
+// Upstreams returns the addresses of the DNS servers and the urls of
+// the DNS over HTTPS servers the server forwards to
+func (s *Server) Upstreams() ([]string, []string) {
+	servers, serversHttps := s.upstreams()
+
+	addresses := make([]string, len(servers))
+	for i, server := range servers {
+		addresses[i] = server.String()
+	}
+
+	return addresses, append([]string(nil), serversHttps...)
+}
+
+// Stats returns the query statistics collected by the server
+func (s *Server) Stats() *stats.Stats {
+	return s.stats
+}
+
+// Feed returns the live feed of the handled queries
+func (s *Server) Feed() *Feed {
+	return s.feed
 }
 
 // Shutdown gracefully
 func (s *Server) Shutdown() error {
-	return s.server.Shutdown()
+	return s.ShutdownContext(context.Background())
+}
+
+// ShutdownContext stops listening and waits for the in-flight requests to
+// be answered until ctx is done, then closes the query log and dnstap output
+func (s *Server) ShutdownContext(ctx context.Context) error {
+	err := s.listeners.Shutdown(ctx)
+
+	if s.queryLog != nil {
+		if closeErr := s.queryLog.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	s.tap.Close()
+
+	return err
 }
 
 // Get a random DNS server to query.
 func (s *Server) getRandServer() string {
+	servers, _ := s.upstreams()
 	rand.Seed(time.Now().Unix())
-	n := rand.Int() % len(s.servers)
-	return s.servers[n].String()
+	n := rand.Int() % len(servers)
+	return servers[n].String()
 }
 
 // Get a random DNS server to query over HTTPs.
 func (s *Server) getRandServerHttps() string {
+	_, serversHttps := s.upstreams()
 	rand.Seed(time.Now().Unix())
-	n := rand.Int() % len(s.serversHttps)
-	return s.serversHttps[n]
+	n := rand.Int() % len(serversHttps)
+	return serversHttps[n]
 }
 
 func (s *Server) makeDNSoverHTTPSrequest(url string, dnsMsg *dns.Msg) (*dns.Msg, error) {
@@ -114,21 +300,38 @@ func (s *Server) makeDNSoverHTTPSrequest(url string, dnsMsg *dns.Msg) (*dns.Msg,
 	return answer, nil
 }
 
-func (s *Server) callFirstSuccessfulServer(request *dns.Msg) (serverResponse *dns.Msg, err error) {
-	for _, serverUrl := range s.serversHttps {
+// Ask the DNS servers in order and return the first answer and the server that gave it
+func (s *Server) callFirstSuccessfulServer(request *dns.Msg) (serverResponse *dns.Msg, upstream string, err error) {
+	servers, serversHttps := s.upstreams()
+
+	for _, serverUrl := range serversHttps {
+		start := time.Now()
+		s.tap.ForwarderQuery(request, serverUrl, start)
 		serverResponse, err = s.makeDNSoverHTTPSrequest(serverUrl, request)
+		metrics.UpstreamLatency.WithLabelValues(serverUrl).Observe(time.Since(start).Seconds())
+		s.stats.RecordUpstream(serverUrl, time.Since(start), err)
 		if err != nil {
-			log.Printf("server: %s, failed with: %s", serverUrl, err)
+			slog.Warn("upstream request failed", "upstream", serverUrl, "err", err)
+			metrics.UpstreamErrors.WithLabelValues(serverUrl).Inc()
 		} else {
+			s.tap.ForwarderResponse(request, serverResponse, serverUrl, start, time.Now())
+			upstream = serverUrl
 			return
 		}
 	}
 
-	for _, serverAddr := range s.servers {
+	for _, serverAddr := range servers {
+		start := time.Now()
+		s.tap.ForwarderQuery(request, serverAddr.String(), start)
 		serverResponse, _, err = s.dnsClient.Exchange(request, serverAddr.String())
+		metrics.UpstreamLatency.WithLabelValues(serverAddr.String()).Observe(time.Since(start).Seconds())
+		s.stats.RecordUpstream(serverAddr.String(), time.Since(start), err)
 		if err != nil {
-			log.Printf("server: %s, failed with: %s", serverAddr.String(), err)
+			slog.Warn("upstream request failed", "upstream", serverAddr.String(), "err", err)
+			metrics.UpstreamErrors.WithLabelValues(serverAddr.String()).Inc()
 		} else {
+			s.tap.ForwarderResponse(request, serverResponse, serverAddr.String(), start, time.Now())
+			upstream = serverAddr.String()
 			return
 		}
 	}
@@ -136,26 +339,28 @@ func (s *Server) callFirstSuccessfulServer(request *dns.Msg) (serverResponse *dn
 	return
 }
 
-// Make a DNS request to a server
-func (s *Server) makeRequest(questions []dns.Question) (dns.Msg, bool) {
+// Make a DNS request to a server with the given OPT record
+// Returns the response and the server that answered
+func (s *Server) makeRequest(questions []dns.Question, opt *dns.OPT) (dns.Msg, string, bool) {
 	request := new(dns.Msg)
 	request.Id = dns.Id()
 	request.RecursionDesired = true
 	request.Question = make([]dns.Question, len(questions))
 	copy(request.Question, questions)
+	request.Extra = []dns.RR{opt}
 
-	serverResponse, err := s.callFirstSuccessfulServer(request)
+	serverResponse, upstream, err := s.callFirstSuccessfulServer(request)
 
 	if err != nil {
-		log.Printf("%s\n", err.Error())
-		return dns.Msg{}, false
+		slog.Error("no upstream answered", "err", err)
+		return dns.Msg{}, "", false
 	}
 
 	if serverResponse == nil {
-		return dns.Msg{}, false
+		return dns.Msg{}, "", false
 	}
 
-	return *serverResponse, true
+	return *serverResponse, upstream, true
 }
 
 // If something went wrong - inform the client
@@ -173,43 +378,104 @@ func (s *Server) shouldSendErrorResponse(response dns.Msg, status bool) int {
 
 // Act as a forwarding server without caching
 // This is in the case where the query is not of type A or AAAA
-func (s *Server) passThrough(dnsWriter dns.ResponseWriter, clientRequest *dns.Msg) {
-	serverResponse, ok := s.makeRequest(clientRequest.Question)
+// The DO bit of the client is forwarded as is
+func (s *Server) passThrough(dnsWriter *responseRecorder, clientRequest *dns.Msg, client clientEdns) {
+	metrics.PassThrough.WithLabelValues(metrics.QtypeLabel(qtypeString(clientRequest))).Inc()
+	dnsWriter.passThrough = true
+
+	opt := upstreamOpt(client, client.do, s.Config().Server.Edns)
+	serverResponse, upstream, ok := s.makeRequest(clientRequest.Question, opt)
+	dnsWriter.upstream = upstream
 
 	reply := new(dns.Msg)
 
 	rcode := s.shouldSendErrorResponse(serverResponse, ok)
 	if rcode != dns.RcodeSuccess {
 		reply.SetRcode(clientRequest, rcode)
-		dnsWriter.WriteMsg(reply)
+		s.writeReply(dnsWriter, reply, client, nil)
 		return
 	}
 
 	reply.SetReply(clientRequest)
+	fillReply(reply, &serverResponse, client)
+	s.writeReply(dnsWriter, reply, client, &serverResponse)
+}
+
+// Record the metrics and statistics of a handled client request
+func (s *Server) observe(clientRequest *dns.Msg, recorder *responseRecorder) {
+	metrics.Queries.WithLabelValues(metrics.QtypeLabel(qtypeString(clientRequest)), recorder.rcode()).Inc()
 
-	reply.Answer = make([]dns.RR, len(serverResponse.Answer))
-	copy(reply.Answer, serverResponse.Answer)
+	if recorder.reply != nil {
+		s.tap.ClientResponse(clientRequest, recorder.reply, recorder.RemoteAddr(), recorder.LocalAddr(), recorder.protocol, recorder.start, time.Now())
+	}
 
-	reply.Ns = make([]dns.RR, len(serverResponse.Ns))
-	copy(reply.Ns, serverResponse.Ns)
+	query := stats.Query{
+		Client: recorder.client(),
+		Cached: recorder.cached,
+		Rcode:  -1,
+	}
+	if len(clientRequest.Question) > 0 {
+		query.Name = clientRequest.Question[0].Name
+	}
+	if recorder.reply != nil {
+		query.Rcode = recorder.reply.Rcode
+	}
 
-	reply.Extra = make([]dns.RR, len(serverResponse.Extra))
-	copy(reply.Extra, serverResponse.Extra)
+	s.stats.RecordQuery(query)
 
-	dnsWriter.WriteMsg(reply)
+	if s.queryLog == nil && !s.feed.active() {
+		return
+	}
+
+	entry := logging.QueryEntry{
+		Time:          recorder.start,
+		Client:        query.Client,
+		Name:          query.Name,
+		Type:          qtypeString(clientRequest),
+		Rcode:         recorder.rcode(),
+		Cache:         recorder.cacheStatus(),
+		Upstream:      recorder.upstream,
+		LatencyMillis: float64(time.Since(recorder.start)) / float64(time.Millisecond),
+	}
+
+	if s.queryLog != nil {
+		if err := s.queryLog.Log(entry); err != nil {
+			slog.Error("query log write failed", "err", err)
+		}
+	}
+
+	s.feed.publish(entry)
 }
 
 // Handle a client request
 // Check if there is a cache record and return it or create it
 // Ask one of the DNS servers if the record is not in the cache
 func (s *Server) HandleRequest(dnsWriter dns.ResponseWriter, clientRequest *dns.Msg) {
+	metrics.InFlight.Inc()
+	defer metrics.InFlight.Dec()
+
+	recorder := newResponseRecorder(dnsWriter)
+	defer s.observe(clientRequest, recorder)
+	dnsWriter = recorder
+
+	s.tap.ClientQuery(clientRequest, recorder.RemoteAddr(), recorder.LocalAddr(), recorder.protocol, recorder.start)
+
+	cfg := s.Config().Server.Edns
+	client := newClientEdns(clientRequest, cfg)
+	if client.enabled && client.version != 0 {
+		reply := new(dns.Msg)
+		reply.SetRcode(clientRequest, dns.RcodeBadVers)
+		s.writeReply(dnsWriter, reply, client, nil)
+		return
+	}
+
 	if (len(clientRequest.Question)) != 1 {
-		s.passThrough(dnsWriter, clientRequest)
+		s.passThrough(recorder, clientRequest, client)
 		return
 	}
 
 	if clientRequest.Question[0].Qtype != dns.TypeA && clientRequest.Question[0].Qtype != dns.TypeAAAA {
-		s.passThrough(dnsWriter, clientRequest)
+		s.passThrough(recorder, clientRequest, client)
 		return
 	}
 
@@ -227,41 +493,43 @@ func (s *Server) HandleRequest(dnsWriter dns.ResponseWriter, clientRequest *dns.
 
 	if hit {
 		response = cachedMsg
+		recorder.cached = true
 	} else {
+		// always ask for the signatures, so that the cache can answer DO clients too
 		var ok bool
-		response, ok = s.makeRequest(clientRequest.Question)
+		response, recorder.upstream, ok = s.makeRequest(clientRequest.Question, upstreamOpt(client, true, cfg))
 
 		rcode := s.shouldSendErrorResponse(response, ok)
 		if rcode != dns.RcodeSuccess {
 			reply.SetRcode(clientRequest, rcode)
-			dnsWriter.WriteMsg(reply)
+			s.writeReply(dnsWriter, reply, client, nil)
 			return
 		}
 
-		s.cache.Insert(dns.Fqdn(question), response)
+		s.cache.Insert(dns.Fqdn(question), cacheable(&response))
 	}
 
 	reply.SetReply(clientRequest)
-
-	reply.Answer = make([]dns.RR, len(response.Answer))
-	copy(reply.Answer, response.Answer)
-
-	reply.Ns = make([]dns.RR, len(response.Ns))
-	copy(reply.Ns, response.Ns)
-
-	reply.Extra = make([]dns.RR, len(response.Extra))
-	copy(reply.Extra, response.Extra)
-
-	dnsWriter.WriteMsg(reply)
+	fillReply(reply, &response, client)
+	s.writeReply(dnsWriter, reply, client, &response)
 }
 
-// Start the server
+// Start the server on all its listeners
 func (s *Server) ListenAndServe() error {
-	dns.HandleFunc(".", s.HandleRequest)
-
-	if err := s.server.ListenAndServe(); err != nil {
+	if err := s.Listen(nil); err != nil {
 		return err
 	}
 
-	return nil
+	return s.Serve()
+}
+
+// Listen binds the addresses of all the listeners, taking the matching
+// sockets passed by systemd socket activation instead of binding them
+func (s *Server) Listen(sockets *systemd.Sockets) error {
+	return s.listeners.Listen(sockets)
+}
+
+// Serve answers the requests on the bound listeners until they are shut down
+func (s *Server) Serve() error {
+	return s.listeners.Serve()
 }
@@ -1,12 +1,16 @@
 package server
 
 import (
+	"fmt"
 	"net/http"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/dvlahovski/go-dnscached/cache"
 	"github.com/dvlahovski/go-dnscached/test"
+	"github.com/miekg/dns"
 )
 
 func GetServer(t *testing.T) *Server {
@@ -81,3 +85,88 @@ func TestHandleRequest(t *testing.T) {
 		t.Errorf("mismatching question")
 	}
 }
+
+func TestFeed(t *testing.T) {
+	server := GetServer(t)
+	queries := server.Feed().Subscribe()
+	defer server.Feed().Unsubscribe(queries)
+
+	msg := test.GetDnsMsgQuestion()
+	server.HandleRequest(new(test.StubResponseWriter), msg)
+
+	select {
+	case entry := <-queries:
+		if entry.Name != msg.Question[0].Name || entry.Type != "A" {
+			t.Fatalf("unexpected query %v", entry)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("query not published")
+	}
+}
+
+func TestApply(t *testing.T) {
+	server := GetServer(t)
+	config := test.GetStubConfig()
+	config.Server.Servers = []string{"1.1.1.1:53", "9.9.9.9:53"}
+
+	if err := server.Apply(config); err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+
+	servers, _ := server.upstreams()
+	if len(servers) != 2 || servers[0].String() != "1.1.1.1:53" {
+		t.Fatalf("unexpected servers %v", servers)
+	}
+
+	config = test.GetStubConfig()
+	config.Server.Servers = nil
+	if err := server.Apply(config); err == nil {
+		t.Fatal("apply should fail without servers")
+	}
+
+	if err := server.Reload(); err == nil {
+		t.Fatal("reload should fail without a config file")
+	}
+}
+
+func TestConcurrentApply(t *testing.T) {
+	server := GetServer(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		config := test.GetStubConfig()
+		config.Cache.MaxEntries = 1 + i%2
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Apply(config)
+		}()
+	}
+	wg.Wait()
+
+	// the cache has the capacity of the config the server ended with
+	capacity := server.Config().Cache.MaxEntries
+	for i := 0; i < capacity; i++ {
+		if !server.cache.InsertFromParams(fmt.Sprintf("a%d.bg", i), "1.2.3.4", dns.TypeA, 0) {
+			t.Fatalf("expected room for %d entries", capacity)
+		}
+	}
+	if server.cache.InsertFromParams("full.bg", "1.2.3.4", dns.TypeA, 0) {
+		t.Fatalf("expected a capacity of %d entries", capacity)
+	}
+}
+
+func TestUpdateWithoutFile(t *testing.T) {
+	server := GetServer(t)
+	before, _ := server.upstreams()
+
+	config := test.GetStubConfig()
+	config.Server.Servers = []string{"1.1.1.1:53"}
+	if err := server.Update(config); err == nil {
+		t.Fatal("update should fail without a config file to store to")
+	}
+
+	if servers, _ := server.upstreams(); !reflect.DeepEqual(servers, before) {
+		t.Fatalf("a config that can't be stored should not be applied, got %v", servers)
+	}
+}
@@ -0,0 +1,314 @@
+package stats
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/miekg/dns"
+)
+
+// TopCount is the number of entries in each of the top lists
+const TopCount = 10
+
+// maxKeys is the number of distinct domains or clients counted per bucket
+const maxKeys = 100 * TopCount
+
+// Query is the information recorded for every handled client query
+type Query struct {
+	Name   string
+	Client string
+	Rcode  int
+	Cached bool
+}
+
+// Count is a key and the number of times it was seen in the window
+type Count struct {
+	Key   string
+	Count int
+}
+
+// Point is the hit ratio of a single bucket of the window
+type Point struct {
+	Time     int64
+	Queries  int
+	Hits     int
+	HitRatio float64
+}
+
+// Upstream is the latency summary of a single upstream server
+type Upstream struct {
+	Upstream  string
+	Requests  int
+	Errors    int
+	AvgMillis float64
+	MaxMillis float64
+}
+
+// Snapshot is the computed statistics over the whole window
+type Snapshot struct {
+	Window      int
+	Resolution  int
+	Queries     int
+	Hits        int
+	Misses      int
+	HitRatio    float64
+	History     []Point
+	TopDomains  []Count
+	TopClients  []Count
+	TopNXDomain []Count
+	Upstreams   []Upstream
+}
+
+type upstreamBucket struct {
+	requests int
+	errors   int
+	total    time.Duration
+	max      time.Duration
+}
+
+type bucket struct {
+	start     int64
+	queries   int
+	hits      int
+	domains   map[string]int
+	clients   map[string]int
+	nxdomains map[string]int
+	upstreams map[string]*upstreamBucket
+}
+
+func (b *bucket) reset(start int64) {
+	b.start = start
+	b.queries = 0
+	b.hits = 0
+	b.domains = make(map[string]int)
+	b.clients = make(map[string]int)
+	b.nxdomains = make(map[string]int)
+	b.upstreams = make(map[string]*upstreamBucket)
+}
+
+// Stats keeps query statistics over a rolling window split in buckets
+type Stats struct {
+	lock       sync.Mutex
+	resolution int64
+	buckets    []bucket
+	now        func() time.Time
+}
+
+// New returns a Stats instance configured from the stats config
+// A zero resolution falls back to a minute
+func New(cfg config.StatsConfig) *Stats {
+	s := new(Stats)
+	s.now = time.Now
+	s.resolution = int64(cfg.Resolution)
+	if s.resolution <= 0 {
+		s.resolution = 60
+	}
+
+	count := int64(cfg.Window) / s.resolution
+	if count <= 0 {
+		count = 1
+	}
+
+	s.buckets = make([]bucket, count)
+	return s
+}
+
+// Get the current bucket, resetting it if it holds data from an older period
+func (s *Stats) current() *bucket {
+	start := s.now().Unix() / s.resolution * s.resolution
+	b := &s.buckets[(start/s.resolution)%int64(len(s.buckets))]
+	if b.start != start {
+		b.reset(start)
+	}
+
+	return b
+}
+
+// RecordQuery adds a handled client query to the current bucket
+func (s *Stats) RecordQuery(q Query) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b := s.current()
+	b.queries++
+	if q.Cached {
+		b.hits++
+	}
+
+	if q.Name != "" {
+		name := strings.ToLower(q.Name)
+		count(b.domains, name)
+		if q.Rcode == dns.RcodeNameError {
+			count(b.nxdomains, name)
+		}
+	}
+
+	if q.Client != "" {
+		count(b.clients, q.Client)
+	}
+}
+
+// Count a key in a map of at most maxKeys keys. Once it is full, a new key
+// takes the place and the count of the least counted one (the space-saving
+// algorithm), so a flood of random names can't grow it, while the frequent
+// keys are still counted.
+func count(counts map[string]int, key string) {
+	if _, ok := counts[key]; ok || len(counts) < maxKeys {
+		counts[key]++
+		return
+	}
+
+	minKey, min := "", 0
+	for k, c := range counts {
+		if minKey == "" || c < min {
+			minKey, min = k, c
+		}
+	}
+
+	delete(counts, minKey)
+	counts[key] = min + 1
+}
+
+// RecordUpstream adds a request to an upstream server to the current bucket
+func (s *Stats) RecordUpstream(upstream string, duration time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b := s.current()
+	u, ok := b.upstreams[upstream]
+	if !ok {
+		u = new(upstreamBucket)
+		b.upstreams[upstream] = u
+	}
+
+	u.requests++
+	if err != nil {
+		u.errors++
+	}
+
+	u.total += duration
+	if duration > u.max {
+		u.max = duration
+	}
+}
+
+// Sort the counts descending and keep the first TopCount
+func top(counts map[string]int) []Count {
+	result := make([]Count, 0, len(counts))
+	for key, count := range counts {
+		result = append(result, Count{Key: key, Count: count})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Key < result[j].Key
+	})
+
+	if len(result) > TopCount {
+		result = result[:TopCount]
+	}
+
+	return result
+}
+
+func ratio(hits, queries int) float64 {
+	if queries == 0 {
+		return 0
+	}
+
+	return float64(hits) / float64(queries)
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Snapshot computes the statistics over the buckets still in the window
+func (s *Stats) Snapshot() Snapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	snapshot := Snapshot{
+		Window:     int(s.resolution) * len(s.buckets),
+		Resolution: int(s.resolution),
+	}
+
+	domains := make(map[string]int)
+	clients := make(map[string]int)
+	nxdomains := make(map[string]int)
+	upstreams := make(map[string]*upstreamBucket)
+
+	oldest := s.now().Unix()/s.resolution*s.resolution - s.resolution*int64(len(s.buckets)-1)
+	for i := range s.buckets {
+		b := &s.buckets[i]
+		if b.start < oldest || b.domains == nil {
+			continue
+		}
+
+		snapshot.Queries += b.queries
+		snapshot.Hits += b.hits
+		snapshot.History = append(snapshot.History, Point{
+			Time:     b.start,
+			Queries:  b.queries,
+			Hits:     b.hits,
+			HitRatio: ratio(b.hits, b.queries),
+		})
+
+		for key, count := range b.domains {
+			domains[key] += count
+		}
+		for key, count := range b.clients {
+			clients[key] += count
+		}
+		for key, count := range b.nxdomains {
+			nxdomains[key] += count
+		}
+		for key, u := range b.upstreams {
+			total, ok := upstreams[key]
+			if !ok {
+				total = new(upstreamBucket)
+				upstreams[key] = total
+			}
+			total.requests += u.requests
+			total.errors += u.errors
+			total.total += u.total
+			if u.max > total.max {
+				total.max = u.max
+			}
+		}
+	}
+
+	sort.Slice(snapshot.History, func(i, j int) bool {
+		return snapshot.History[i].Time < snapshot.History[j].Time
+	})
+
+	snapshot.Misses = snapshot.Queries - snapshot.Hits
+	snapshot.HitRatio = ratio(snapshot.Hits, snapshot.Queries)
+	snapshot.TopDomains = top(domains)
+	snapshot.TopClients = top(clients)
+	snapshot.TopNXDomain = top(nxdomains)
+
+	for key, u := range upstreams {
+		upstream := Upstream{
+			Upstream:  key,
+			Requests:  u.requests,
+			Errors:    u.errors,
+			MaxMillis: millis(u.max),
+		}
+		if u.requests > 0 {
+			upstream.AvgMillis = millis(u.total) / float64(u.requests)
+		}
+		snapshot.Upstreams = append(snapshot.Upstreams, upstream)
+	}
+
+	sort.Slice(snapshot.Upstreams, func(i, j int) bool {
+		return snapshot.Upstreams[i].Upstream < snapshot.Upstreams[j].Upstream
+	})
+
+	return snapshot
+}
@@ -0,0 +1,127 @@
+package stats
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/miekg/dns"
+)
+
+func newStats(now *time.Time) *Stats {
+	s := New(config.StatsConfig{Window: 300, Resolution: 60})
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func TestRecordQuery(t *testing.T) {
+	now := time.Unix(6000, 0)
+	s := newStats(&now)
+
+	s.RecordQuery(Query{Name: "google.bg.", Client: "127.0.0.1", Cached: true})
+	s.RecordQuery(Query{Name: "Google.bg.", Client: "127.0.0.1"})
+	s.RecordQuery(Query{Name: "nx.bg.", Client: "127.0.0.2", Rcode: dns.RcodeNameError})
+
+	snapshot := s.Snapshot()
+	if snapshot.Queries != 3 || snapshot.Hits != 1 || snapshot.Misses != 2 {
+		t.Fatalf("unexpected counts %d/%d/%d", snapshot.Queries, snapshot.Hits, snapshot.Misses)
+	}
+
+	if snapshot.TopDomains[0].Key != "google.bg." || snapshot.TopDomains[0].Count != 2 {
+		t.Fatalf("unexpected top domain %v", snapshot.TopDomains[0])
+	}
+
+	if snapshot.TopClients[0].Key != "127.0.0.1" || snapshot.TopClients[0].Count != 2 {
+		t.Fatalf("unexpected top client %v", snapshot.TopClients[0])
+	}
+
+	if len(snapshot.TopNXDomain) != 1 || snapshot.TopNXDomain[0].Key != "nx.bg." {
+		t.Fatalf("unexpected nxdomains %v", snapshot.TopNXDomain)
+	}
+}
+
+func TestWindowExpires(t *testing.T) {
+	now := time.Unix(6000, 0)
+	s := newStats(&now)
+
+	s.RecordQuery(Query{Name: "google.bg.", Cached: true})
+	now = now.Add(2 * time.Minute)
+	s.RecordQuery(Query{Name: "dir.bg."})
+
+	snapshot := s.Snapshot()
+	if snapshot.Queries != 2 || len(snapshot.History) != 2 {
+		t.Fatalf("expected 2 queries in 2 buckets, got %d in %d", snapshot.Queries, len(snapshot.History))
+	}
+
+	if snapshot.History[0].HitRatio != 1 || snapshot.History[1].HitRatio != 0 {
+		t.Fatalf("unexpected history %v", snapshot.History)
+	}
+
+	now = now.Add(4 * time.Minute)
+	snapshot = s.Snapshot()
+	if snapshot.Queries != 1 {
+		t.Fatalf("expected the first query to leave the window, got %d queries", snapshot.Queries)
+	}
+}
+
+func TestTopCount(t *testing.T) {
+	now := time.Unix(6000, 0)
+	s := newStats(&now)
+
+	for i := 0; i < TopCount+5; i++ {
+		s.RecordQuery(Query{Name: fmt.Sprintf("%d.bg.", i)})
+	}
+
+	if len(s.Snapshot().TopDomains) != TopCount {
+		t.Fatalf("expected %d top domains", TopCount)
+	}
+}
+
+func TestBoundedKeys(t *testing.T) {
+	now := time.Unix(6000, 0)
+	s := newStats(&now)
+
+	for i := 0; i < 100; i++ {
+		s.RecordQuery(Query{Name: "google.bg.", Client: "127.0.0.1"})
+	}
+	// a random subdomain flood
+	for i := 0; i < 3*maxKeys; i++ {
+		s.RecordQuery(Query{Name: fmt.Sprintf("r%d.flood.bg.", i), Client: "127.0.0.1", Rcode: dns.RcodeNameError})
+	}
+
+	b := s.current()
+	if len(b.domains) > maxKeys || len(b.nxdomains) > maxKeys {
+		t.Fatalf("expected at most %d keys, got %d and %d", maxKeys, len(b.domains), len(b.nxdomains))
+	}
+
+	if top := s.Snapshot().TopDomains[0]; top.Key != "google.bg." || top.Count != 100 {
+		t.Fatalf("the frequent domain should still be counted, got %v", top)
+	}
+}
+
+func TestRecordUpstream(t *testing.T) {
+	now := time.Unix(6000, 0)
+	s := newStats(&now)
+
+	s.RecordUpstream("8.8.8.8:53", 10*time.Millisecond, nil)
+	s.RecordUpstream("8.8.8.8:53", 30*time.Millisecond, fmt.Errorf("timeout"))
+
+	upstreams := s.Snapshot().Upstreams
+	if len(upstreams) != 1 {
+		t.Fatalf("expected 1 upstream, got %d", len(upstreams))
+	}
+
+	u := upstreams[0]
+	if u.Requests != 2 || u.Errors != 1 || u.AvgMillis != 20 || u.MaxMillis != 30 {
+		t.Fatalf("unexpected upstream summary %v", u)
+	}
+}
+
+func TestZeroConfig(t *testing.T) {
+	s := New(config.StatsConfig{})
+	s.RecordQuery(Query{Name: "google.bg."})
+	if snapshot := s.Snapshot(); snapshot.Queries != 1 {
+		t.Fatalf("expected 1 query, got %d", snapshot.Queries)
+	}
+}
@@ -0,0 +1,176 @@
+// Package systemd implements socket activation (LISTEN_FDS) and the
+// sd_notify readiness, stopping and watchdog notifications
+package systemd
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// Sockets are the sockets passed by systemd socket activation.
+// The sockets are matched to the listeners of the config by their address.
+// A nil *Sockets has no sockets.
+type Sockets struct {
+	lock        sync.Mutex
+	listeners   []net.Listener
+	packetConns []net.PacketConn
+}
+
+// Activated returns the sockets passed in LISTEN_FDS;
+// there are none if the daemon wasn't socket activated
+func Activated() *Sockets {
+	s := new(Sockets)
+	for _, file := range activation.Files(true) {
+		if listener, err := net.FileListener(file); err == nil {
+			s.listeners = append(s.listeners, listener)
+		} else if conn, err := net.FilePacketConn(file); err == nil {
+			s.packetConns = append(s.packetConns, conn)
+		} else {
+			slog.Warn("ignoring unsupported activated socket", "name", file.Name(), "err", err)
+		}
+		file.Close()
+	}
+
+	return s
+}
+
+// Check if a socket address is the one of a host:port config address
+func sameAddress(address string, addr net.Addr) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	socketHost, socketPort, err := net.SplitHostPort(addr.String())
+	if err != nil || port != socketPort {
+		return false
+	}
+
+	socketIP := net.ParseIP(socketHost)
+	if host == "" {
+		return socketIP != nil && socketIP.IsUnspecified()
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+
+	for _, ip := range ips {
+		if ip.Equal(socketIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Listener takes the stream socket bound to address, or returns nil if there is none
+func (s *Sockets) Listener(address string) net.Listener {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, listener := range s.listeners {
+		if sameAddress(address, listener.Addr()) {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			return listener
+		}
+	}
+
+	return nil
+}
+
+// PacketConn takes the datagram socket bound to address, or returns nil if there is none
+func (s *Sockets) PacketConn(address string) net.PacketConn {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, conn := range s.packetConns {
+		if sameAddress(address, conn.LocalAddr()) {
+			s.packetConns = append(s.packetConns[:i], s.packetConns[i+1:]...)
+			return conn
+		}
+	}
+
+	return nil
+}
+
+// Close the sockets that weren't taken by any listener
+func (s *Sockets) Close() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, listener := range s.listeners {
+		slog.Warn("closing unused activated socket", "address", listener.Addr().String())
+		listener.Close()
+	}
+
+	for _, conn := range s.packetConns {
+		slog.Warn("closing unused activated socket", "address", conn.LocalAddr().String())
+		conn.Close()
+	}
+
+	s.listeners = nil
+	s.packetConns = nil
+}
+
+// Send a notification to systemd, if the daemon is run by it with Type=notify
+func notify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		slog.Warn("systemd notification failed", "state", state, "err", err)
+	}
+}
+
+// Ready notifies systemd that the daemon has started
+func Ready() {
+	notify(daemon.SdNotifyReady)
+}
+
+// Stopping notifies systemd that the daemon is shutting down
+func Stopping() {
+	notify(daemon.SdNotifyStopping)
+}
+
+// Watchdog keeps notifying the systemd watchdog at half its interval until ctx is done.
+// It returns right away if the watchdog isn't enabled for the daemon.
+func Watchdog(ctx context.Context) {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		slog.Warn("systemd watchdog is misconfigured", "err", err)
+		return
+	}
+
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			notify(daemon.SdNotifyWatchdog)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package systemd
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestSockets(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sockets := &Sockets{listeners: []net.Listener{listener}, packetConns: []net.PacketConn{conn}}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	if sockets.Listener("127.0.0.1:1") != nil {
+		t.Fatal("sockets on other ports should not match")
+	}
+
+	if sockets.PacketConn(listener.Addr().String()) != nil {
+		t.Fatal("stream sockets should not be used for packet listeners")
+	}
+
+	if sockets.Listener("localhost:"+port) != listener {
+		t.Fatal("the socket should match the resolved address")
+	}
+
+	if sockets.Listener("localhost:"+port) != nil {
+		t.Fatal("a socket should be taken only once")
+	}
+
+	sockets.Close()
+	if _, err := conn.WriteTo([]byte{0}, conn.LocalAddr()); err == nil {
+		t.Fatal("unused sockets should be closed")
+	}
+
+	var none *Sockets
+	if none.Listener("127.0.0.1:53") != nil || none.PacketConn("127.0.0.1:53") != nil {
+		t.Fatal("nil sockets should have no sockets")
+	}
+}
+
+func TestReady(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	Ready()
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Fatalf("expected READY=1, got %q", buf[:n])
+	}
+}
@@ -0,0 +1,252 @@
+package tap
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+// Version is the version reported in the emitted dnstap frames
+const Version = "go-dnscached"
+
+// Tap emits dnstap frames for the client and forwarder messages to a
+// Frame Streams output. All methods are no-ops on a nil Tap.
+type Tap struct {
+	output   dnstap.Output
+	identity []byte
+	version  []byte
+}
+
+// New opens the dnstap output configured in the dnstap config
+func New(cfg config.DnstapConfig) (*Tap, error) {
+	var output dnstap.Output
+	var err error
+
+	if cfg.Socket != "" {
+		output, err = dnstap.NewFrameStreamSockOutput(&net.UnixAddr{Name: cfg.Socket, Net: "unix"})
+	} else if cfg.File != "" {
+		output, err = dnstap.NewFrameStreamOutputFromFilename(cfg.File)
+	} else {
+		return nil, fmt.Errorf("dnstap socket or file not set")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newTap(output, cfg.Identity), nil
+}
+
+func newTap(output dnstap.Output, identity string) *Tap {
+	t := &Tap{
+		output:  output,
+		version: []byte(Version),
+	}
+
+	if identity != "" {
+		t.identity = []byte(identity)
+	}
+
+	go output.RunOutputLoop()
+	return t
+}
+
+// Close flushes and closes the output
+func (t *Tap) Close() {
+	if t == nil {
+		return
+	}
+
+	t.output.Close()
+}
+
+// Marshal the message in a dnstap frame and queue it without blocking
+func (t *Tap) send(message *dnstap.Message) {
+	frame, err := proto.Marshal(&dnstap.Dnstap{
+		Identity: t.identity,
+		Version:  t.version,
+		Type:     dnstap.Dnstap_MESSAGE.Enum(),
+		Message:  message,
+	})
+	if err != nil {
+		slog.Error("dnstap marshal failed", "err", err)
+		return
+	}
+
+	select {
+	case t.output.GetOutputChannel() <- frame:
+	default:
+		slog.Debug("dnstap output full, dropping frame")
+	}
+}
+
+// Split an address to its IP and port
+func splitAddr(addr net.Addr) (net.IP, uint32) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, uint32(a.Port)
+	case *net.TCPAddr:
+		return a.IP, uint32(a.Port)
+	}
+
+	return nil, 0
+}
+
+// the dnstap transports of the listener protocols
+var socketProtocols = map[string]dnstap.SocketProtocol{
+	config.ListenerUDP: dnstap.SocketProtocol_UDP,
+	config.ListenerTCP: dnstap.SocketProtocol_TCP,
+	config.ListenerDoT: dnstap.SocketProtocol_DOT,
+	config.ListenerDoH: dnstap.SocketProtocol_DOH,
+}
+
+// Parse a forwarder "host:port" address or DNS over HTTPS url
+func parseUpstream(upstream string) (net.IP, uint32, dnstap.SocketProtocol) {
+	if u, err := url.Parse(upstream); err == nil && u.Scheme == "https" {
+		port := uint32(443)
+		if p, err := strconv.Atoi(u.Port()); err == nil {
+			port = uint32(p)
+		}
+		return net.ParseIP(u.Hostname()), port, dnstap.SocketProtocol_DOH
+	}
+
+	host, portStr, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return nil, 0, dnstap.SocketProtocol_UDP
+	}
+
+	port, _ := strconv.Atoi(portStr)
+	return net.ParseIP(host), uint32(port), dnstap.SocketProtocol_UDP
+}
+
+// Set the socket family and the address fields of the message
+func setAddresses(message *dnstap.Message, queryIP net.IP, queryPort uint32, responseIP net.IP, responsePort uint32) {
+	family := dnstap.SocketFamily_INET
+	if (queryIP != nil && queryIP.To4() == nil) || (responseIP != nil && responseIP.To4() == nil) {
+		family = dnstap.SocketFamily_INET6
+	}
+	message.SocketFamily = family.Enum()
+
+	if queryIP != nil {
+		if family == dnstap.SocketFamily_INET {
+			queryIP = queryIP.To4()
+		}
+		message.QueryAddress = queryIP
+		message.QueryPort = proto.Uint32(queryPort)
+	}
+
+	if responseIP != nil {
+		if family == dnstap.SocketFamily_INET {
+			responseIP = responseIP.To4()
+		}
+		message.ResponseAddress = responseIP
+		message.ResponsePort = proto.Uint32(responsePort)
+	}
+}
+
+func pack(msg *dns.Msg) []byte {
+	if msg == nil {
+		return nil
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+
+	return packed
+}
+
+func newMessage(messageType dnstap.Message_Type) *dnstap.Message {
+	return &dnstap.Message{Type: messageType.Enum()}
+}
+
+func setQueryTime(message *dnstap.Message, at time.Time) {
+	message.QueryTimeSec = proto.Uint64(uint64(at.Unix()))
+	message.QueryTimeNsec = proto.Uint32(uint32(at.Nanosecond()))
+}
+
+func setResponseTime(message *dnstap.Message, at time.Time) {
+	message.ResponseTimeSec = proto.Uint64(uint64(at.Unix()))
+	message.ResponseTimeNsec = proto.Uint32(uint32(at.Nanosecond()))
+}
+
+// Create a client message from the client and the local address the query
+// arrived on, over a listener of the given protocol
+func clientMessage(messageType dnstap.Message_Type, client, local net.Addr, protocol string) *dnstap.Message {
+	message := newMessage(messageType)
+	clientIP, clientPort := splitAddr(client)
+	localIP, localPort := splitAddr(local)
+	setAddresses(message, clientIP, clientPort, localIP, localPort)
+	message.SocketProtocol = socketProtocols[protocol].Enum()
+	return message
+}
+
+// ClientQuery emits a CLIENT_QUERY frame for a query received from a client
+func (t *Tap) ClientQuery(query *dns.Msg, client, local net.Addr, protocol string, at time.Time) {
+	if t == nil {
+		return
+	}
+
+	message := clientMessage(dnstap.Message_CLIENT_QUERY, client, local, protocol)
+	setQueryTime(message, at)
+	message.QueryMessage = pack(query)
+	t.send(message)
+}
+
+// ClientResponse emits a CLIENT_RESPONSE frame for a reply sent to a client
+func (t *Tap) ClientResponse(query, response *dns.Msg, client, local net.Addr, protocol string, queryTime, at time.Time) {
+	if t == nil {
+		return
+	}
+
+	message := clientMessage(dnstap.Message_CLIENT_RESPONSE, client, local, protocol)
+	setQueryTime(message, queryTime)
+	setResponseTime(message, at)
+	message.QueryMessage = pack(query)
+	message.ResponseMessage = pack(response)
+	t.send(message)
+}
+
+// Create a forwarder message for the upstream server
+func forwarderMessage(messageType dnstap.Message_Type, upstream string) *dnstap.Message {
+	message := newMessage(messageType)
+	upstreamIP, upstreamPort, protocol := parseUpstream(upstream)
+	setAddresses(message, nil, 0, upstreamIP, upstreamPort)
+	message.SocketProtocol = protocol.Enum()
+	return message
+}
+
+// ForwarderQuery emits a FORWARDER_QUERY frame for a query sent to an upstream server
+func (t *Tap) ForwarderQuery(query *dns.Msg, upstream string, at time.Time) {
+	if t == nil {
+		return
+	}
+
+	message := forwarderMessage(dnstap.Message_FORWARDER_QUERY, upstream)
+	setQueryTime(message, at)
+	message.QueryMessage = pack(query)
+	t.send(message)
+}
+
+// ForwarderResponse emits a FORWARDER_RESPONSE frame for a reply received from an upstream server
+func (t *Tap) ForwarderResponse(query, response *dns.Msg, upstream string, queryTime, at time.Time) {
+	if t == nil {
+		return
+	}
+
+	message := forwarderMessage(dnstap.Message_FORWARDER_RESPONSE, upstream)
+	setQueryTime(message, queryTime)
+	setResponseTime(message, at)
+	message.QueryMessage = pack(query)
+	message.ResponseMessage = pack(response)
+	t.send(message)
+}
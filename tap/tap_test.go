@@ -0,0 +1,97 @@
+package tap
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/test"
+	"google.golang.org/protobuf/proto"
+)
+
+type stubOutput struct {
+	frames chan []byte
+}
+
+func (o *stubOutput) GetOutputChannel() chan []byte { return o.frames }
+func (o *stubOutput) RunOutputLoop()                {}
+func (o *stubOutput) Close()                        {}
+
+func receive(t *testing.T, output *stubOutput) *dnstap.Message {
+	select {
+	case frame := <-output.frames:
+		var dt dnstap.Dnstap
+		if err := proto.Unmarshal(frame, &dt); err != nil {
+			t.Fatalf("invalid frame: %s", err)
+		}
+		return dt.Message
+	default:
+		t.Fatal("no frame emitted")
+	}
+
+	return nil
+}
+
+func TestClientFrames(t *testing.T) {
+	output := &stubOutput{frames: make(chan []byte, 2)}
+	tap := newTap(output, "test")
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.1.2"), Port: 53}
+	now := time.Now()
+
+	tap.ClientQuery(test.GetDnsMsgQuestion(), client, local, config.ListenerUDP, now)
+	tap.ClientResponse(test.GetDnsMsgQuestion(), test.GetDnsMsgAnswer(), client, local, config.ListenerDoT, now, now)
+
+	query := receive(t, output)
+	if query.GetType() != dnstap.Message_CLIENT_QUERY {
+		t.Fatalf("expected CLIENT_QUERY, got %s", query.GetType())
+	}
+
+	if query.GetSocketProtocol() != dnstap.SocketProtocol_UDP {
+		t.Fatalf("expected UDP, got %s", query.GetSocketProtocol())
+	}
+
+	if !net.IP(query.QueryAddress).Equal(client.IP) || query.GetQueryPort() != 5353 {
+		t.Fatalf("unexpected query address %v:%d", query.QueryAddress, query.GetQueryPort())
+	}
+
+	response := receive(t, output)
+	if response.GetType() != dnstap.Message_CLIENT_RESPONSE || len(response.ResponseMessage) == 0 {
+		t.Fatalf("expected CLIENT_RESPONSE with a message, got %s", response.GetType())
+	}
+
+	if response.GetSocketProtocol() != dnstap.SocketProtocol_DOT {
+		t.Fatalf("expected the protocol of the listener, got %s", response.GetSocketProtocol())
+	}
+}
+
+func TestForwarderFrames(t *testing.T) {
+	output := &stubOutput{frames: make(chan []byte, 2)}
+	tap := newTap(output, "")
+	now := time.Now()
+
+	tap.ForwarderQuery(test.GetDnsMsgQuestion(), "8.8.8.8:53", now)
+	tap.ForwarderResponse(test.GetDnsMsgQuestion(), test.GetDnsMsgAnswer(), "https://1.1.1.1/dns-query", now, now)
+
+	query := receive(t, output)
+	if query.GetType() != dnstap.Message_FORWARDER_QUERY || query.GetSocketProtocol() != dnstap.SocketProtocol_UDP {
+		t.Fatalf("unexpected forwarder query %s/%s", query.GetType(), query.GetSocketProtocol())
+	}
+
+	response := receive(t, output)
+	if response.GetType() != dnstap.Message_FORWARDER_RESPONSE || response.GetSocketProtocol() != dnstap.SocketProtocol_DOH {
+		t.Fatalf("unexpected forwarder response %s/%s", response.GetType(), response.GetSocketProtocol())
+	}
+
+	if response.GetResponsePort() != 443 {
+		t.Fatalf("expected port 443, got %d", response.GetResponsePort())
+	}
+}
+
+func TestNilTap(t *testing.T) {
+	var tap *Tap
+	tap.ClientQuery(test.GetDnsMsgQuestion(), nil, nil, config.ListenerUDP, time.Now())
+	tap.Close()
+}
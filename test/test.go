@@ -21,6 +21,8 @@ func GetStubConfig() *config.Config {
 	cfg.Server.Servers = make([]string, 1)
 	cfg.Server.Servers[0] = "8.8.8.8:53"
 
+	cfg.SetDefaults()
+
 	return cfg
 }
 
@@ -0,0 +1,134 @@
+package web
+
+import (
+	"embed"
+	"errors"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+)
+
+// the pages, scripts and templates, built into the binary
+//
+//go:embed static
+var embedded embed.FS
+
+// overlay serves the files of dir, falling back to the ones of base
+type overlay struct {
+	dir  fs.FS
+	base fs.FS
+}
+
+func (o overlay) Open(name string) (fs.File, error) {
+	f, err := o.dir.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.base.Open(name)
+	}
+
+	return f, err
+}
+
+// assets are the static files and the parsed page templates of the web GUI
+type assets struct {
+	files fs.FS
+	// the pages of each language
+	pages map[string]map[string]*template.Template
+	// re-parse the templates on every request
+	reload bool
+}
+
+// Load the built-in assets, overlaid with the files of dir if it is not empty.
+// The templates are parsed once, or on every request from dir.
+func newAssets(dir string) (*assets, error) {
+	files, err := fs.Sub(embedded, "static")
+	if err != nil {
+		return nil, err
+	}
+
+	a := &assets{files: files}
+	if dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, errors.New(dir + " is not a directory")
+		}
+
+		slog.Info("serving the web GUI assets from a directory", "dir", dir)
+		a.files = overlay{dir: os.DirFS(dir), base: files}
+		a.reload = true
+	}
+
+	if a.pages, err = a.parse(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Parse every page together with the common layout, once for each language
+func (a *assets) parse() (map[string]map[string]*template.Template, error) {
+	names, err := fs.Glob(embedded, "static/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	catalogs, err := loadCatalogs(a.files)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := make(map[string]map[string]*template.Template)
+	for lang, messages := range catalogs {
+		funcs := template.FuncMap{
+			"t":        messages.translate,
+			"lang":     func() string { return lang },
+			"messages": func() catalog { return messages },
+		}
+
+		pages[lang] = make(map[string]*template.Template)
+		for _, name := range names {
+			page := path.Base(name)
+			if page == "template.html" {
+				continue
+			}
+
+			t, err := template.New(page).Funcs(templateFuncs).Funcs(funcs).ParseFS(a.files, page, "template.html")
+			if err != nil {
+				return nil, err
+			}
+			pages[lang][page] = t
+		}
+	}
+
+	return pages, nil
+}
+
+// execute the template of a page in the language of the request
+func (web *WEB) render(w http.ResponseWriter, req *http.Request, page string, data interface{}) {
+	pages := web.assets.pages
+	if web.assets.reload {
+		var err error
+		if pages, err = web.assets.parse(); err != nil {
+			handleError(err, w)
+			return
+		}
+	}
+
+	lang := language(req)
+	t, ok := pages[lang][page]
+	if !ok {
+		handleError(errors.New("no such page "+page), w)
+		return
+	}
+
+	w.Header().Set("Content-Language", lang)
+	w.Header().Set("Vary", "Accept-Language, Cookie")
+	if err := t.Execute(w, data); err != nil {
+		slog.Error("HTML template execution failed", "page", page, "err", err)
+	}
+}
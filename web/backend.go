@@ -0,0 +1,67 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/dvlahovski/go-dnscached/cache"
+	"github.com/dvlahovski/go-dnscached/client"
+	"github.com/dvlahovski/go-dnscached/server"
+	"github.com/dvlahovski/go-dnscached/stats"
+)
+
+// Backend is where the web GUI reads the cache and the statistics from.
+// A *client.Client is the backend of a web GUI showing a remote daemon.
+// Invalid searches fail with a 400 *client.Error.
+type Backend interface {
+	ListCache(ctx context.Context, q client.CacheQuery) (client.CachePage, error)
+	Stats(ctx context.Context) (stats.Snapshot, error)
+}
+
+// the backend reading the cache and server of this process directly
+type local struct {
+	server *server.Server
+	cache  *cache.Cache
+}
+
+// Local returns the backend of a web GUI running in the daemon process
+func Local(server *server.Server, cache *cache.Cache) Backend {
+	return local{server: server, cache: cache}
+}
+
+func invalidSearch(err error) error {
+	return &client.Error{Status: http.StatusBadRequest, Message: err.Error()}
+}
+
+func (l local) ListCache(ctx context.Context, q client.CacheQuery) (client.CachePage, error) {
+	opts := cache.ListOptions{
+		Prefix:     q.Prefix,
+		Contains:   q.Contains,
+		Type:       q.Type,
+		Sort:       strings.TrimPrefix(q.Sort, "-"),
+		Descending: strings.HasPrefix(q.Sort, "-"),
+		Limit:      q.Limit,
+		Cursor:     q.Cursor,
+	}
+
+	if q.Regex != "" {
+		re, err := regexp.Compile(q.Regex)
+		if err != nil {
+			return client.CachePage{}, invalidSearch(err)
+		}
+		opts.Regexp = re
+	}
+
+	result, err := l.cache.List(opts)
+	if err != nil {
+		return client.CachePage{}, invalidSearch(err)
+	}
+
+	return client.CachePage{Entries: result.Entries, Total: result.Total, Next: result.Next}, nil
+}
+
+func (l local) Stats(ctx context.Context) (stats.Snapshot, error) {
+	return l.server.Stats().Snapshot(), nil
+}
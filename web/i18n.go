@@ -0,0 +1,81 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// the languages of the web GUI, the first one is the default
+var languages = []string{"en", "bg"}
+
+// the cookie set by the language toggle of the pages
+const langCookie = "lang"
+
+// catalog maps the message keys to the messages of a language
+type catalog map[string]string
+
+// Get the message of key, formatted with args. Missing keys are shown as is.
+func (c catalog) translate(key string, args ...interface{}) string {
+	message, ok := c[key]
+	if !ok {
+		return key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+
+	return message
+}
+
+// Load the catalogs of all the languages from the locales directory of files
+func loadCatalogs(files fs.FS) (map[string]catalog, error) {
+	catalogs := make(map[string]catalog)
+	for _, lang := range languages {
+		name := "locales/" + lang + ".json"
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return nil, err
+		}
+
+		var c catalog
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		catalogs[lang] = c
+	}
+
+	return catalogs, nil
+}
+
+// Get the language of the request: the one picked with the toggle, else the
+// most preferred one of the Accept-Language header, else the default one
+func language(req *http.Request) string {
+	if cookie, err := req.Cookie(langCookie); err == nil && slices.Contains(languages, cookie.Value) {
+		return cookie.Value
+	}
+
+	best, bestQ := languages[0], 0.0
+	for _, part := range strings.Split(req.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+
+		// en-US matches en
+		base, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if q > bestQ && slices.Contains(languages, base) {
+			best, bestQ = base, q
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,93 @@
+package web
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dvlahovski/go-dnscached/config"
+)
+
+func TestCatalogs(t *testing.T) {
+	files, err := fs.Sub(embedded, "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	catalogs, err := loadCatalogs(files)
+	if err != nil {
+		t.Fatalf("loading the catalogs failed: %s", err)
+	}
+
+	// every message is translated to every language
+	base := catalogs[languages[0]]
+	for _, lang := range languages[1:] {
+		for key := range base {
+			if _, ok := catalogs[lang][key]; !ok {
+				t.Errorf("%s is missing %s", lang, key)
+			}
+		}
+		for key := range catalogs[lang] {
+			if _, ok := base[key]; !ok {
+				t.Errorf("%s has the unknown key %s", lang, key)
+			}
+		}
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	cases := []struct {
+		acceptLanguage string
+		cookie         string
+		lang           string
+	}{
+		{"", "", "en"},
+		{"bg", "", "bg"},
+		{"bg-BG,bg;q=0.9,en;q=0.8", "", "bg"},
+		{"en-US,en;q=0.9,bg;q=0.8", "", "en"},
+		{"de;q=1.0, bg;q=0.5, en;q=0.4", "", "bg"},
+		{"de, fr", "", "en"},
+		{"en", "bg", "bg"},
+		{"bg", "de", "bg"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Language", c.acceptLanguage)
+		if c.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: langCookie, Value: c.cookie})
+		}
+
+		if lang := language(req); lang != c.lang {
+			t.Errorf("%q with cookie %q: expected %s, got %s", c.acceptLanguage, c.cookie, c.lang, lang)
+		}
+	}
+}
+
+func TestTranslatedPages(t *testing.T) {
+	s, err := New(&config.WebConfig{}, &config.ApiConfig{Address: "127.0.0.1:8282"}, nil, nil)
+	if err != nil {
+		t.Fatalf("web creation error: %s", err)
+	}
+
+	for lang, title := range map[string]string{"en": "Live queries", "bg": "Заявки на живо"} {
+		req := httptest.NewRequest(http.MethodGet, "/queries", nil)
+		req.Header.Set("Accept-Language", lang)
+		w := httptest.NewRecorder()
+		s.Handler.ServeHTTP(w, req)
+
+		body := w.Body.String()
+		if !strings.Contains(body, "<h1>"+title+"</h1>") || !strings.Contains(body, `<html lang="`+lang+`">`) {
+			t.Errorf("expected the %s page, got %q", lang, body)
+		}
+		if w.Header().Get("Content-Language") != lang {
+			t.Errorf("expected Content-Language %s, got %q", lang, w.Header().Get("Content-Language"))
+		}
+		// the scripts get the catalog of the page
+		if !strings.Contains(body, `"action.pause":`) {
+			t.Errorf("expected the messages of the scripts in the %s page", lang)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+$(document).ready(function() {
+    // the running config, as last returned by the API or optimistically changed
+    var config = null;
+    // the index of the static record being edited, -1 when adding
+    var editing = -1;
+
+    function isIPv4(value) {
+        var parts = value.split(".");
+        return parts.length === 4 && parts.every(function (part) {
+            return /^\d{1,3}$/.test(part) && parseInt(part, 10) <= 255;
+        });
+    }
+
+    function isIPv6(value) {
+        return value.indexOf(":") !== -1 && /^[0-9a-fA-F:.]+$/.test(value);
+    }
+
+    function isHostPort(value) {
+        var match = /^(\[([^\]]+)\]|[^:\[\]]+):(\d{1,5})$/.exec(value);
+        return match !== null && parseInt(match[3], 10) <= 65535;
+    }
+
+    function isHttpsUrl(value) {
+        return /^https:\/\/[^\s\/]+(\/\S*)?$/.test(value);
+    }
+
+    function isDomain(value) {
+        return /^([a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?\.)*[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?\.?$/.test(value);
+    }
+
+    // mark an input as invalid until it is changed
+    function check(input, valid) {
+        input.toggleClass("is-invalid", !valid);
+        return valid;
+    }
+
+    function showError(xhr, fallback) {
+        var message = fallback;
+        if (xhr.responseJSON && xhr.responseJSON.Message) {
+            message = xhr.responseJSON.Message;
+        }
+        $("#admin-error").text(message).show();
+    }
+
+    function removeButton(onClick) {
+        return $("<button class='btn btn-sm btn-danger'>").text(t("action.remove")).click(onClick);
+    }
+
+    function renderUpstreams(list, tbody) {
+        tbody.empty();
+        (config.Server[list] || []).forEach(function (server, i) {
+            tbody.append($("<tr>").append(
+                $("<td>").text(server),
+                $("<td class='text-right'>").append(removeButton(function () {
+                    update(function (next) {
+                        next.Server[list].splice(i, 1);
+                    });
+                }))
+            ));
+        });
+    }
+
+    function renderStaticRecords() {
+        var tbody = $("#static-records").empty();
+        (config.CacheEntries || []).forEach(function (entry, i) {
+            var edit = $("<button class='btn btn-sm btn-secondary mr-2'>").text(t("action.edit")).click(function () {
+                editing = i;
+                $("#static-key").val(entry.Key);
+                $("#static-value").val(entry.Value);
+                $("#static-type").val(entry.Type);
+                $("#static-ttl").val(entry.Ttl);
+                $("#static-submit").text(t("action.save"));
+                $("#static-cancel").show();
+            });
+
+            tbody.append($("<tr>").append(
+                $("<td>").text(entry.Key),
+                $("<td>").text(entry.Value),
+                $("<td>").text(entry.Type),
+                $("<td>").text(entry.Ttl === 0 ? "∞" : entry.Ttl),
+                $("<td class='text-right'>").append(edit, removeButton(function () {
+                    update(function (next) {
+                        next.CacheEntries.splice(i, 1);
+                    });
+                }))
+            ));
+        });
+    }
+
+    function render() {
+        renderUpstreams("Servers", $("#servers"));
+        renderUpstreams("ServersHTTPS", $("#servers-https"));
+        renderStaticRecords();
+    }
+
+    function load() {
+        $.ajax({
+            url: api_url + "/v1/config",
+            dataType: "json",
+            success: function (cfg) {
+                config = cfg;
+                render();
+            },
+            error: function (xhr) {
+                showError(xhr, t("admin.load_error"));
+            }
+        });
+    }
+
+    // Apply a change to a copy of the config and show it at once, then store it
+    // through the API and roll it back if the API rejects it
+    function update(change) {
+        var previous = config;
+        var next = JSON.parse(JSON.stringify(config));
+        change(next);
+        config = next;
+        render();
+
+        $.ajax({
+            url: api_url + "/v1/config",
+            type: "PUT",
+            contentType: "application/json",
+            data: JSON.stringify(next),
+            dataType: "json",
+            crossDomain: true,
+            success: function (applied) {
+                if (config === next) {
+                    config = applied;
+                    render();
+                }
+                $("#admin-error").hide();
+            },
+            error: function (xhr) {
+                if (config === next) {
+                    config = previous;
+                    render();
+                }
+                showError(xhr, t("admin.save_error"));
+            }
+        });
+    }
+
+    $(".upstream-form").submit(function (event) {
+        event.preventDefault();
+        var list = $(this).attr("data-list");
+        var input = $(this).find("input");
+        var value = input.val().trim();
+        var valid = list === "ServersHTTPS" ? isHttpsUrl(value) : isHostPort(value);
+        if (!check(input, valid)) {
+            return;
+        }
+
+        input.val("");
+        update(function (next) {
+            next.Server[list] = (next.Server[list] || []).concat([value]);
+        });
+    });
+
+    function resetStaticForm() {
+        editing = -1;
+        $("#static-form")[0].reset();
+        $("#static-form input").removeClass("is-invalid");
+        $("#static-submit").text(t("action.add"));
+        $("#static-cancel").hide();
+    }
+
+    $("#static-cancel").click(resetStaticForm);
+
+    $("#static-form").submit(function (event) {
+        event.preventDefault();
+        var entry = {
+            Key: $("#static-key").val().trim(),
+            Value: $("#static-value").val().trim(),
+            Type: $("#static-type").val(),
+            Ttl: parseInt($("#static-ttl").val() || "0", 10),
+        };
+
+        var validKey = check($("#static-key"), isDomain(entry.Key));
+        var validValue = check($("#static-value"), entry.Type === "A" ? isIPv4(entry.Value) : isIPv6(entry.Value));
+        var validTtl = check($("#static-ttl"), entry.Ttl >= 0);
+        if (!validKey || !validValue || !validTtl) {
+            return;
+        }
+
+        var index = editing;
+        resetStaticForm();
+        update(function (next) {
+            next.CacheEntries = next.CacheEntries || [];
+            if (index >= 0) {
+                next.CacheEntries[index] = entry;
+            } else {
+                next.CacheEntries.push(entry);
+            }
+        });
+    });
+
+    $("input").on("input", function () {
+        $(this).removeClass("is-invalid");
+    });
+
+    load();
+});
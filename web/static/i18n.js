@@ -0,0 +1,13 @@
+// Get the message of key in the language of the page
+function t(key) {
+    return messages.hasOwnProperty(key) ? messages[key] : key;
+}
+
+$(document).ready(function() {
+    // remember the picked language for all the pages
+    $(".lang-toggle").click(function (event) {
+        event.preventDefault();
+        document.cookie = "lang=" + $(this).attr("data-lang") + "; path=/; max-age=31536000; SameSite=Lax";
+        location.reload();
+    });
+});
@@ -1,38 +1,64 @@
 $(document).ready(function() {
+    function recordUrl(name, type) {
+        return api_url + "/v1/cache/" + encodeURIComponent(name) + "/" + type;
+    }
+
+    function isIPv4(value) {
+        var parts = value.split(".");
+        return parts.length === 4 && parts.every(function (part) {
+            return /^\d{1,3}$/.test(part) && parseInt(part, 10) <= 255;
+        });
+    }
+
+    function isIPv6(value) {
+        return value.indexOf(":") !== -1 && /^[0-9a-fA-F:.]+$/.test(value);
+    }
+
+    // the row is removed at once and put back if the API fails
     $(".delete-button").click(function () {
-        if(!confirm('Сигурни ли сте?')) {
+        if(!confirm(t("cache.confirm_delete"))) {
             return;
         }
+        var row = $(this).closest("tr").hide();
         $.ajax({
-            url: "http://" + api_address + "/cache/delete",
-            data: {
-                key: $(this).attr("data-key"),
-            },
-            type: "GET",
+            url: recordUrl($(this).attr("data-name"), $(this).attr("data-type")),
+            type: "DELETE",
             crossDomain: true,
+            success: function () {
+                row.remove();
+            },
             error: function (xhr, status) {
-                alert("Грешка при изтриване!");
+                row.show();
+                alert(t("cache.delete_error"));
             }
         });
-        location.reload();
     });
 
     $("#add-form").submit(function(event) {
+        event.preventDefault();
+        var ip = $("#add-ip").val().trim();
+        var valid = $("#add-type").val() === "A" ? isIPv4(ip) : isIPv6(ip);
+        $("#add-ip").toggleClass("is-invalid", !valid);
+        $("#add-url").toggleClass("is-invalid", $("#add-url").val().trim() === "");
+        if ($("#add-url, #add-ip").filter(".is-invalid").length > 0) {
+            return;
+        }
+
         $.ajax({
-            url: "http://" + api_address + "/cache/insert",
-            data: {
-                key: $("#add-url").val(),
-                type: $("#add-type").val(),
-                value: $("#add-ip").val(),
-                ttl: $("#add-ttl").val(),
-            },
-            type: "GET",
+            url: recordUrl($("#add-url").val().trim(), $("#add-type").val()),
+            type: "PUT",
+            contentType: "application/json",
+            data: JSON.stringify({
+                Value: ip,
+                Ttl: parseInt($("#add-ttl").val() || "0", 10),
+            }),
             crossDomain: true,
+            success: function () {
+                location.reload();
+            },
             error: function (xhr, status) {
-                alert("Грешка при добавяне!");
+                alert(t("cache.add_error"));
             }
         });
-        // location.reload();
-        // event.preventDefault();
     });
-});
\ No newline at end of file
+});
@@ -0,0 +1,67 @@
+$(document).ready(function() {
+    var maxRows = 500;
+    var source = null;
+    var paused = false;
+
+    function cell(text) {
+        return $("<td>").text(text);
+    }
+
+    function connect() {
+        if (source !== null) {
+            source.close();
+        }
+
+        var url = api_url + "/v1/queries/stream";
+        var params = [];
+        var filter = $("#filter").val();
+        if (filter !== "") {
+            params.push("filter=" + encodeURIComponent(filter));
+        }
+        if (params.length > 0) {
+            url += "?" + params.join("&");
+        }
+
+        source = new EventSource(url);
+        source.onmessage = function (event) {
+            if (paused) {
+                return;
+            }
+
+            var query = JSON.parse(event.data);
+            var row = $("<tr>").append(
+                cell(new Date(query.Time).toLocaleTimeString()),
+                cell(query.Client),
+                cell(query.Name),
+                cell(query.Type),
+                cell(query.Rcode),
+                cell(query.Cache),
+                cell(query.Upstream || ""),
+                cell(query.LatencyMillis.toFixed(2))
+            );
+
+            $("#queries").prepend(row);
+            $("#queries tr").slice(maxRows).remove();
+        };
+    }
+
+    var timer = null;
+    $("#filter").on("input", function () {
+        clearTimeout(timer);
+        timer = setTimeout(function () {
+            $("#queries").empty();
+            connect();
+        }, 300);
+    });
+
+    $("#filter-form").submit(function (event) {
+        event.preventDefault();
+    });
+
+    $("#pause-button").click(function () {
+        paused = !paused;
+        $(this).text(t(paused ? "action.resume" : "action.pause"));
+    });
+
+    connect();
+});
\ No newline at end of file
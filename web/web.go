@@ -1,46 +1,127 @@
 package web
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"io/ioutil"
-	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/dvlahovski/go-dnscached/api"
 	"github.com/dvlahovski/go-dnscached/cache"
+	"github.com/dvlahovski/go-dnscached/certs"
+	"github.com/dvlahovski/go-dnscached/client"
 	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/server"
+	"github.com/dvlahovski/go-dnscached/stats"
 )
 
 // Web insance
 type WEB struct {
-	apiCfg *config.ApiConfig
+	backend Backend
+	apiUrl  string
+	assets  *assets
 }
 
 type Page struct {
 	CacheEntries []cache.StringEntry
-	ApiAddress   string
+	ApiUrl       string
+	Search       CacheSearch
+	Total        int
+	FirstUrl     string
+	NextUrl      string
+	SortUrls     map[string]string
+	Error        string
 }
 
-func (web *WEB) getCacheEntries() ([]cache.StringEntry, error) {
-	res, err := http.Get("http://" + web.apiCfg.Address + "/cache/all")
-	if err != nil {
-		return nil, err
+// the number of cache entries on a page of the cache table
+const pageSize = 50
+
+// CacheSearch is the search, filter and order of the cache table,
+// from the query params of the page
+type CacheSearch struct {
+	Search string
+	// contains, prefix or regex
+	Mode   string
+	Type   string
+	Sort   string
+	Cursor string
+}
+
+func newCacheSearch(query url.Values) CacheSearch {
+	return CacheSearch{
+		Search: query.Get("search"),
+		Mode:   query.Get("mode"),
+		Type:   query.Get("type"),
+		Sort:   query.Get("sort"),
+		Cursor: query.Get("cursor"),
 	}
-	contents, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
-	if err != nil {
-		return nil, err
+}
+
+// Get the API query of the search
+func (s CacheSearch) query() client.CacheQuery {
+	q := client.CacheQuery{Type: s.Type, Sort: s.Sort, Limit: pageSize, Cursor: s.Cursor}
+	switch s.Mode {
+	case "prefix":
+		q.Prefix = s.Search
+	case "regex":
+		q.Regex = s.Search
+	default:
+		q.Contains = s.Search
 	}
 
-	var cacheEntries []cache.StringEntry
-	err = json.Unmarshal(contents, &cacheEntries)
-	if err != nil {
-		return nil, err
+	return q
+}
+
+// Get the URL of the cache table with the same search in the given order, from the cursor
+func (s CacheSearch) url(sort string, cursor string) string {
+	query := url.Values{}
+	for param, value := range map[string]string{
+		"search": s.Search, "mode": s.Mode, "type": s.Type, "sort": sort, "cursor": cursor,
+	} {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+
+	// relative to the page, wherever the web GUI is mounted
+	return "?" + query.Encode()
+}
+
+// Get the URLs sorting the table by each column, reversing the current order
+func (s CacheSearch) sortUrls() map[string]string {
+	urls := make(map[string]string)
+	for _, column := range []string{cache.SortName, cache.SortExpiry, cache.SortHits} {
+		next := column
+		if s.Sort == column || (s.Sort == "" && column == cache.SortName) {
+			next = "-" + column
+		}
+		urls[column] = s.url(next, "")
 	}
 
-	return cacheEntries, nil
+	return urls
+}
+
+type StatsPage struct {
+	Stats  stats.Snapshot
+	ApiUrl string
+}
+
+var templateFuncs = template.FuncMap{
+	"toHumanTime": func(timestamp int) string {
+		if timestamp == 0 {
+			return "∞"
+		}
+		return time.Unix(int64(timestamp), 0).Format("15:04:05 02.01.2006")
+	},
+	"toClock": func(timestamp int64) string {
+		return time.Unix(timestamp, 0).Format("15:04")
+	},
+	"toPercent": func(ratio float64) string {
+		return fmt.Sprintf("%.1f", ratio*100)
+	},
 }
 
 func handleError(err error, w http.ResponseWriter) {
@@ -50,48 +131,229 @@ func handleError(err error, w http.ResponseWriter) {
 }
 
 func (web *WEB) index(w http.ResponseWriter, req *http.Request) {
-	cacheEntries, err := web.getCacheEntries()
-	if err != nil {
+	search := newCacheSearch(req.URL.Query())
+	p := &Page{
+		ApiUrl:   web.apiUrl,
+		Search:   search,
+		SortUrls: search.sortUrls(),
+	}
+
+	page, err := web.backend.ListCache(req.Context(), search.query())
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusBadRequest {
+		// an invalid search, e.g. a broken regex
+		p.Error = apiErr.Message
+	} else if err != nil {
 		handleError(err, w)
 		return
 	}
 
-	p := &Page{
-		CacheEntries: cacheEntries,
-		ApiAddress:   web.apiCfg.Address,
-	}
-
-	t, err := template.New("index.html").Funcs(template.FuncMap{
-		"toHumanTime": func(timestamp int) string {
-			if timestamp == 0 {
-				return "∞"
-			}
-			return time.Unix(int64(timestamp), 0).Format("15:04:05 02.01.2006")
-		},
-		"getKey": func(addr string, recordType string) string {
-			return fmt.Sprintf("%s.%s.", addr, recordType)
-		},
-	}).ParseFiles("web/static/index.html", "web/static/template.html")
+	p.CacheEntries = page.Entries
+	p.Total = page.Total
+	if page.Next != "" {
+		p.NextUrl = search.url(search.Sort, page.Next)
+	}
+	if search.Cursor != "" {
+		p.FirstUrl = search.url(search.Sort, "")
+	}
+
+	web.render(w, req, "index.html", p)
+}
+
+func (web *WEB) stats(w http.ResponseWriter, req *http.Request) {
+	snapshot, err := web.backend.Stats(req.Context())
 	if err != nil {
 		handleError(err, w)
 		return
 	}
 
-	if err := t.Execute(w, p); err != nil {
-		log.Printf("HTML template parsing failed: %s", err)
+	p := &StatsPage{
+		Stats:  snapshot,
+		ApiUrl: web.apiUrl,
 	}
+
+	web.render(w, req, "stats.html", p)
 }
 
-// Run the Web HTTP server
-func Run(cfg *config.WebConfig, apiCfg *config.ApiConfig) error {
-	web := new(WEB)
-	web.apiCfg = apiCfg
+// the admin page edits the upstreams and the static records through the
+// config API, so the API token needs the admin scope
+func (web *WEB) admin(w http.ResponseWriter, req *http.Request) {
+	p := &Page{
+		ApiUrl: web.apiUrl,
+	}
+
+	web.render(w, req, "admin.html", p)
+}
+
+func (web *WEB) queries(w http.ResponseWriter, req *http.Request) {
+	p := &Page{
+		ApiUrl: web.apiUrl,
+	}
+
+	web.render(w, req, "queries.html", p)
+}
+
+// Get the URL of the API of this daemon and the HTTP client calling it: HTTPS
+// if the API serves TLS, trusting its certificate and presenting the web
+// certificate if the API asks for one
+func apiClient(cfg *config.WebConfig, apiCfg *config.ApiConfig) (string, *http.Client, error) {
+	httpClient := &http.Client{Timeout: 15 * time.Second}
+	if !apiCfg.TLS.Enabled() {
+		return "http://" + apiCfg.Address, httpClient, nil
+	}
+
+	// the API certificate is most likely self-signed
+	tlsConfig, err := client.TLSConfig(apiCfg.TLS.CertFile, "", "")
+	if err != nil {
+		return "", nil, err
+	}
+
+	if cfg.TLS.Enabled() {
+		reloader, err := certs.New(cfg.TLS)
+		if err != nil {
+			return "", nil, err
+		}
+		tlsConfig.GetClientCertificate = reloader.ClientCertificate
+	}
+
+	httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	return "https://" + apiCfg.Address, httpClient, nil
+}
+
+// Pass the API calls of the pages on to api. The calls of other origins are
+// refused, so that another site can't make a browser call the API with the
+// credentials of its user. The query stream is kept open past the write
+// timeout of the web server.
+func apiHandler(api http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if crossOrigin(req) {
+			http.Error(w, "cross-origin API calls are not allowed", http.StatusForbidden)
+			return
+		}
+
+		if req.URL.Path == "/api/v1/queries/stream" {
+			http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		}
+		api.ServeHTTP(w, req)
+	})
+}
+
+// Check whether a request may come from a page of another origin: a preflight,
+// a request of another site or origin, or a body a form can send
+func crossOrigin(req *http.Request) bool {
+	if req.Method == http.MethodOptions {
+		return true
+	}
+
+	if origin := req.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != req.Host {
+			return true
+		}
+	}
+
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return true
+	}
+
+	if req.ContentLength != 0 {
+		mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewHandler returns the web GUI showing the data of backend. The pages call
+// the API through api, served under api/, or at their own origin if api is nil.
+// All the links are relative, so the handler can be mounted under any path.
+func NewHandler(backend Backend, api http.Handler, assetsDir string) (http.Handler, error) {
+	web := &WEB{backend: backend}
+
+	var err error
+	if web.assets, err = newAssets(assetsDir); err != nil {
+		return nil, err
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", web.index)
-	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("web/static"))))
+	mux.HandleFunc("/stats", web.stats)
+	mux.HandleFunc("/queries", web.queries)
+	mux.HandleFunc("/admin", web.admin)
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(web.assets.files))))
+	if api != nil {
+		web.apiUrl = "api"
+		mux.Handle("/api/v1/", apiHandler(http.StripPrefix("/api", api)))
+	}
+
+	return mux, nil
+}
+
+// Handler returns the web GUI of this daemon. The local backend reads the cache
+// and the statistics in-process, the remote one through the API at cfg.ApiUrl,
+// by default the API of this daemon.
+//
+// The pages call the API of this daemon with the credentials of the user: at
+// their own origin on the API port, otherwise through the web server, which
+// then asks for the same credentials as the API. cfg.ApiToken is only used by
+// the remote backend and never reaches the browser.
+func Handler(cfg *config.WebConfig, apiCfg *config.ApiConfig, server *server.Server, cache *cache.Cache) (http.Handler, error) {
+	apiUrl, httpClient, err := apiClient(cfg, apiCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := cfg.Backend == config.WebBackendRemote
+	if remote && cfg.ApiUrl != "" {
+		apiUrl = cfg.ApiUrl
+	}
+	c := client.New(apiUrl, cfg.ApiToken, httpClient)
+
+	var backend Backend = Local(server, cache)
+	if remote {
+		backend = c
+	}
+
+	var proxy http.Handler
+	if !cfg.SharePort || (remote && cfg.ApiUrl != "") {
+		if proxy, err = c.Proxy(); err != nil {
+			return nil, err
+		}
+	}
+
+	handler, err := NewHandler(backend, proxy, cfg.AssetsDir)
+	if err != nil || cfg.SharePort {
+		return handler, err
+	}
+
+	// on the API port the API authenticates the web GUI
+	apiConfig := func() *config.ApiConfig { return apiCfg }
+	if server != nil {
+		apiConfig = func() *config.ApiConfig { return &server.Config().Api }
+	}
+	return api.Authenticate(apiConfig, handler), nil
+}
+
+// New returns the web GUI server of this daemon on its own address, ready to
+// ListenAndServe or, if its TLSConfig is set, ListenAndServeTLS
+func New(cfg *config.WebConfig, apiCfg *config.ApiConfig, server *server.Server, cache *cache.Cache) (*http.Server, error) {
+	handler, err := Handler(cfg, apiCfg, server, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &http.Server{Addr: cfg.Address, Handler: handler, WriteTimeout: 1 * time.Second}
+	if cfg.TLS.Enabled() {
+		reloader, err := certs.New(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		s.TLSConfig = reloader.TLSConfig()
+	}
 
-	s := &http.Server{Addr: cfg.Address, Handler: mux, WriteTimeout: 1 * time.Second}
-	log.Printf("Starting Web GUI server on %s", s.Addr)
-	return s.ListenAndServe()
+	return s, nil
 }
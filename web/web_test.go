@@ -0,0 +1,191 @@
+package web
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dvlahovski/go-dnscached/cache"
+	"github.com/dvlahovski/go-dnscached/config"
+	"github.com/dvlahovski/go-dnscached/server"
+	"github.com/dvlahovski/go-dnscached/test"
+	"github.com/miekg/dns"
+)
+
+// Get the response of the web GUI with the given config to a GET of path
+func get(t *testing.T, cfg config.WebConfig, path string) *httptest.ResponseRecorder {
+	s, err := New(&cfg, &config.ApiConfig{Address: "127.0.0.1:8282"}, nil, nil)
+	if err != nil {
+		t.Fatalf("web creation error: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	s.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestEmbeddedAssets(t *testing.T) {
+	a, err := newAssets("")
+	if err != nil {
+		t.Fatalf("parsing the built-in templates failed: %s", err)
+	}
+
+	for _, lang := range languages {
+		for _, page := range []string{"index.html", "stats.html", "queries.html", "admin.html"} {
+			if _, ok := a.pages[lang][page]; !ok {
+				t.Errorf("page %s is not parsed in %s", page, lang)
+			}
+		}
+	}
+
+	// the assets don't depend on the working directory
+	t.Chdir(t.TempDir())
+	if w := get(t, config.WebConfig{}, "/static/index.js"); w.Code != http.StatusOK {
+		t.Fatalf("expected the built-in script, got %d", w.Code)
+	}
+
+	if w := get(t, config.WebConfig{}, "/queries"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "queries.js") {
+		t.Fatalf("expected the queries page, got %d", w.Code)
+	}
+}
+
+func TestAssetsDir(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.js"), []byte("// override"), 0644)
+	cfg := config.WebConfig{AssetsDir: dir}
+
+	if w := get(t, cfg, "/static/index.js"); w.Body.String() != "// override" {
+		t.Fatalf("expected the file of the directory, got %q", w.Body)
+	}
+
+	if w := get(t, cfg, "/static/admin.js"); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("missing files should fall back to the built-in ones, got %d", w.Code)
+	}
+
+	s, err := New(&cfg, &config.ApiConfig{Address: "127.0.0.1:8282"}, nil, nil)
+	if err != nil {
+		t.Fatalf("web creation error: %s", err)
+	}
+
+	// the templates of the directory are re-read on every request
+	layout := `{{define "template_start"}}<title>changed</title>{{end}}{{define "template_end"}}{{end}}`
+	os.WriteFile(filepath.Join(dir, "template.html"), []byte(layout), 0644)
+
+	w := httptest.NewRecorder()
+	s.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/queries", nil))
+	if !strings.Contains(w.Body.String(), "<title>changed</title>") {
+		t.Fatalf("expected the changed layout, got %q", w.Body)
+	}
+
+	if _, err := newAssets(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("a missing directory should fail")
+	}
+}
+
+func TestLocalBackend(t *testing.T) {
+	cfg := test.GetStubConfig()
+	cfg.SetDefaults()
+
+	c := cache.NewCache(*cfg)
+	s, err := server.NewServer(c, cfg, new(test.StubDnsClient), &http.Client{})
+	if err != nil {
+		t.Fatalf("server creation error: %s", err)
+	}
+	c.InsertFromParams("local.example.", "10.0.0.1", dns.TypeA, 60)
+
+	// the API address is never called
+	handler, err := Handler(&cfg.Web, &config.ApiConfig{Address: "127.0.0.1:1"}, s, c)
+	if err != nil {
+		t.Fatalf("web creation error: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?search=local", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "10.0.0.1") {
+		t.Fatalf("expected the cache entry, got %d %q", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?search=(&mode=regex", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "alert-danger") {
+		t.Fatalf("expected the regex error on the page, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the stats page, got %d", w.Code)
+	}
+}
+
+func TestApiProxy(t *testing.T) {
+	var authorization string
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get("Authorization")
+		w.Write([]byte("{}"))
+	}))
+	defer apiServer.Close()
+
+	cfg := config.WebConfig{ApiToken: "secret"}
+	apiCfg := &config.ApiConfig{
+		Address: strings.TrimPrefix(apiServer.URL, "http://"),
+		Tokens: []config.TokenConfig{
+			{Token: "reader", Scope: config.ScopeRead},
+			{Token: "secret", Scope: config.ScopeAdmin},
+		},
+	}
+	handler, err := Handler(&cfg, apiCfg, nil, nil)
+	if err != nil {
+		t.Fatalf("web creation error: %s", err)
+	}
+
+	for _, path := range []string{"/admin", "/queries", "/api/v1/config"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("%s should need credentials, got %d", path, w.Code)
+		}
+	}
+
+	tests := []struct {
+		method  string
+		token   string
+		headers map[string]string
+		code    int
+	}{
+		{http.MethodGet, "reader", nil, http.StatusOK},
+		{http.MethodPut, "reader", map[string]string{"Content-Type": "application/json"}, http.StatusForbidden},
+		{http.MethodPut, "secret", map[string]string{"Content-Type": "application/json"}, http.StatusOK},
+		{http.MethodPost, "secret", map[string]string{"Content-Type": "text/plain"}, http.StatusForbidden},
+		{http.MethodGet, "reader", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{http.MethodGet, "reader", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{http.MethodOptions, "reader", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{http.MethodGet, "reader", map[string]string{"Origin": "http://example.com"}, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		authorization = ""
+		var body io.Reader
+		if test.method == http.MethodPut || test.method == http.MethodPost {
+			body = strings.NewReader("{}")
+		}
+		req := httptest.NewRequest(test.method, "/api/v1/config", body)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("%s with %s and %v: expected %d, got %d", test.method, test.token, test.headers, test.code, w.Code)
+		}
+		if w.Code == http.StatusOK && authorization != "Bearer "+test.token {
+			t.Errorf("the API calls should keep the credentials of the user, got %q", authorization)
+		}
+	}
+}
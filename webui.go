@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dvlahovski/go-dnscached/web"
+)
+
+// Serve only the web GUI, showing the daemon behind the API of the flags
+func webCommand(args []string) int {
+	flags := flag.NewFlagSet("web", flag.ExitOnError)
+	apiFlags := newApiFlags(flags)
+	listen := flags.String("listen", "localhost:8080", "address to serve the web GUI on")
+	assetsDir := flags.String("assets", "", "directory with web GUI files overriding the built-in ones")
+	flags.Parse(args)
+
+	c, baseURL := apiFlags.client()
+	proxy, err := c.Proxy()
+	if err != nil {
+		return fail(err)
+	}
+
+	handler, err := web.NewHandler(c, proxy, *assetsDir)
+	if err != nil {
+		return fail(err)
+	}
+
+	s := &http.Server{Addr: *listen, Handler: handler, WriteTimeout: 15 * time.Second}
+	failures := make(chan error, 1)
+	go func() {
+		slog.Info("starting web GUI server", "address", s.Addr, "api", baseURL)
+		if err := s.ListenAndServe(); err != http.ErrServerClosed {
+			failures <- fmt.Errorf("web GUI server failed: %w", err)
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case sig := <-sigs:
+		slog.Info("caught signal", "signal", sig)
+	case err := <-failures:
+		return fail(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		return fail(err)
+	}
+
+	return 0
+}